@@ -3,9 +3,12 @@ package config
 import (
 	"flag"
 	"fmt"
+	"net/url"
 	"os"
+	"strings"
 
 	"github.com/sogladev/go-manifest-patcher/downloader/internal/filter"
+	"github.com/sogladev/go-manifest-patcher/downloader/internal/httpclient"
 	"github.com/sogladev/go-manifest-patcher/downloader/internal/logger"
 )
 
@@ -14,6 +17,19 @@ type Config struct {
 	LogLevel    string
 	SaveFilter  bool
 	SkipUpdate  bool
+	InstallDir  string
+	Strict      bool
+	Components  []string
+	ResetCustom bool
+	PublicKey   string
+	SkipHooks   bool
+	CAFile      string
+	PinnedCert  string
+	Channel     string
+	ListChannel bool
+	// Token and Signed authenticate with the patch server, Signed holds the parameters of a signed manifest URL
+	Token  string
+	Signed url.Values
 }
 
 func InitConfig() *Config {
@@ -21,6 +37,17 @@ func InitConfig() *Config {
 	logLevel := flag.String("log-level", "info", "Set the log level (debug, info, warning, error)")
 	saveFilter := flag.Bool("save-filter", false, "Save the default filter to filter.json and exit")
 	skipUpdate := flag.Bool("skip-update", false, "Skip update check (useful for development)")
+	strict := flag.Bool("strict-manifest", false, "Reject manifests with unknown fields or a newer schema version")
+	components := flag.String("components", "", "Comma-separated list of optional components to install, or \"all\" (default: components marked as default)")
+	resetCustom := flag.Bool("reset-custom", false, "Overwrite user-customizable files (configs, keybinds) that were modified locally")
+	publicKey := flag.String("public-key", "", "Public key file to verify the manifest signature with (required to run post-install hooks)")
+	skipHooks := flag.Bool("skip-hooks", false, "Do not run post-install hooks from the manifest")
+	caFile := flag.String("ca-file", "", "PEM file with certificate authorities to trust for HTTPS, in addition to the system ones")
+	pinnedCert := flag.String("pin-cert", "", "SHA-256 fingerprint of the server certificate, only this certificate is accepted (allows self-signed certificates)")
+	channel := flag.String("channel", "", "Release channel to install, e.g. \"beta\" (default: the installed channel, or the default channel of the server)")
+	listChannels := flag.Bool("list-channels", false, "List the release channels offered by the server and exit")
+	token := flag.String("token", "", "Access token for servers requiring authentication (default: $PATCHER_TOKEN)")
+	installDir := flag.String("install-dir", ".", "Directory to install and verify files in")
 	flag.Parse()
 
 	if *saveFilter {
@@ -33,10 +60,47 @@ func InitConfig() *Config {
 		os.Exit(0)
 	}
 
+	// -token takes precedence, PATCHER_TOKEN keeps the token out of the process list visible to other users
+	if *token == "" {
+		*token = os.Getenv("PATCHER_TOKEN")
+	}
+
+	// The parameters of a signed manifest URL are sent with every request to the server
+	manifestSource, signed, err := httpclient.SplitSigned(*manifestURL)
+	if err != nil {
+		logger.Error.Fatalf("Invalid manifest URL: %v", err)
+	}
+
 	return &Config{
-		ManifestURL: *manifestURL,
+		ManifestURL: manifestSource,
 		LogLevel:    *logLevel,
 		SaveFilter:  *saveFilter,
 		SkipUpdate:  *skipUpdate,
+		InstallDir:  *installDir,
+		Strict:      *strict,
+		Components:  splitList(*components),
+		ResetCustom: *resetCustom,
+		PublicKey:   *publicKey,
+		SkipHooks:   *skipHooks,
+		CAFile:      *caFile,
+		PinnedCert:  *pinnedCert,
+		Channel:     *channel,
+		ListChannel: *listChannels,
+		Token:       strings.TrimSpace(*token),
+		Signed:      signed,
+	}
+}
+
+// splitList splits a comma-separated flag value, an empty value returns nil
+func splitList(value string) []string {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
+	return items
 }
@@ -4,14 +4,26 @@ import (
 	"fmt"
 	"io/fs"
 	"path/filepath"
+
+	"github.com/sogladev/go-manifest-patcher/downloader/internal/state"
 )
 
-func CollectExtraFiles(f *Filter) (map[string]bool, error) {
+// CollectExtraFiles walks root and returns every file not ignored by the filter.
+// Returned paths are relative to root and use forward slashes, like manifest paths.
+func CollectExtraFiles(f *Filter, root string) (map[string]bool, error) {
 	localFiles := map[string]bool{}
-	err := filepath.WalkDir(".", func(path string, d fs.DirEntry, err error) error {
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() && filepath.Clean(path) == filepath.Join(root, state.Dir) {
+			return filepath.SkipDir // The patcher state is never an extra file
+		}
 		if err == nil && !d.IsDir() {
-			if !f.IsIgnored(path) {
-				localFiles[path] = true
+			relPath, err := filepath.Rel(root, path)
+			if err != nil {
+				return nil
+			}
+			relPath = filepath.ToSlash(relPath)
+			if !f.IsIgnored(relPath) {
+				localFiles[relPath] = true
 			}
 		}
 		return nil
@@ -0,0 +1,171 @@
+package httpclient
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Headers reporting the installed release to the server, used for its adoption statistics
+const (
+	VersionHeader = "X-Patcher-Version"
+	ChannelHeader = "X-Patcher-Channel"
+)
+
+// SignatureParam is the query parameter of signed URLs issued by the patch server
+const SignatureParam = "signature"
+
+// Options configures how the downloader connects to the patch server
+type Options struct {
+	// Header is added to requests to the patch server
+	Header http.Header
+	// Host is the patch server, e.g. "patch.example.com:8443". Headers and credentials are only sent to it,
+	// never to other hosts such as mirrors in file URLs.
+	Host string
+	// Token is sent as "Authorization: Bearer <token>"
+	Token string
+	// Signed holds the query parameters of a signed URL, they are added to every request
+	Signed url.Values
+	// CAFile is a PEM bundle of certificate authorities trusted in addition to the system ones
+	CAFile string
+	// PinnedCert is the SHA-256 fingerprint of the server certificate, hex with optional colons.
+	// When set, only a patch server presenting exactly this certificate is accepted, even if it is self-signed.
+	PinnedCert string
+}
+
+// New creates an HTTP client for opts
+func New(opts Options) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if opts.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		data, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA bundle: %v", err)
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", opts.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	// The pin only applies to the patch server, mirrors and CDNs in file URLs are verified as usual.
+	// Without a patch server, e.g. for a local manifest, it applies to every host.
+	server := transport
+	if opts.PinnedCert != "" {
+		pin, err := parseFingerprint(opts.PinnedCert)
+		if err != nil {
+			return nil, err
+		}
+		server = transport.Clone()
+		// The pin replaces chain verification, so self-signed certificates can be used
+		server.TLSClientConfig = &tls.Config{
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				if len(rawCerts) == 0 {
+					return errors.New("server did not present a certificate")
+				}
+				if actual := sha256.Sum256(rawCerts[0]); actual != pin {
+					return fmt.Errorf("server certificate fingerprint %s does not match the pinned fingerprint", fingerprint(rawCerts[0]))
+				}
+				return nil
+			},
+		}
+		if opts.Host == "" {
+			transport = server
+		}
+	}
+
+	return &http.Client{Transport: &requestTransport{
+		header: opts.Header,
+		host:   opts.Host,
+		token:  opts.Token,
+		signed: opts.Signed,
+		server: server,
+		next:   transport,
+	}}, nil
+}
+
+// requestTransport adds headers and credentials to requests to the patch server
+type requestTransport struct {
+	header http.Header
+	host   string
+	token  string
+	signed url.Values
+	server http.RoundTripper // requests to the patch server
+	next   http.RoundTripper // requests to other hosts
+}
+
+func (t *requestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != t.host {
+		return t.next.RoundTrip(req)
+	}
+	authenticate := t.token != "" || len(t.signed) > 0
+	if len(t.header) == 0 && !authenticate {
+		return t.server.RoundTrip(req)
+	}
+	// A RoundTripper must not modify the caller's request
+	req = req.Clone(req.Context())
+	for key, values := range t.header {
+		req.Header[key] = values
+	}
+	if authenticate {
+		if t.token != "" {
+			req.Header.Set("Authorization", "Bearer "+t.token)
+		}
+		if query := req.URL.Query(); len(t.signed) > 0 && !query.Has(SignatureParam) {
+			for key, values := range t.signed {
+				query[key] = values
+			}
+			req.URL.RawQuery = query.Encode()
+		}
+	}
+	return t.server.RoundTrip(req)
+}
+
+// SplitSigned separates the parameters of a signed URL from rawURL, so they can be added to every
+// request with Options.Signed. URLs without a signature are returned unchanged with nil parameters.
+func SplitSigned(rawURL string) (string, url.Values, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", nil, err
+	}
+	signed := u.Query()
+	if !signed.Has(SignatureParam) {
+		return rawURL, nil, nil
+	}
+	u.RawQuery = ""
+	return u.String(), signed, nil
+}
+
+// fingerprint returns the SHA-256 fingerprint of a DER encoded certificate as colon separated hex
+func fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// parseFingerprint decodes a SHA-256 fingerprint, with or without colons
+func parseFingerprint(value string) ([sha256.Size]byte, error) {
+	var pin [sha256.Size]byte
+	value = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(value)), "sha256:")
+	decoded, err := hex.DecodeString(strings.ReplaceAll(value, ":", ""))
+	if err != nil || len(decoded) != sha256.Size {
+		return pin, fmt.Errorf("invalid certificate fingerprint %q, expected a SHA-256 fingerprint", value)
+	}
+	copy(pin[:], decoded)
+	return pin, nil
+}
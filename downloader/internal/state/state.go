@@ -0,0 +1,81 @@
+package state
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sogladev/go-manifest-patcher/pkg/manifest"
+)
+
+// Dir is the directory inside the install directory where the patcher keeps its state
+const Dir = ".patcher"
+
+const (
+	stateFile    = "installed.json"
+	manifestFile = "manifest.json"
+)
+
+// State describes the last successfully applied manifest
+type State struct {
+	Version     string    `json:"Version"`
+	Components  []string  `json:"Components,omitempty"`
+	Channel     string    `json:"Channel,omitempty"`
+	InstalledAt time.Time `json:"InstalledAt"`
+}
+
+// Load reads the state of an install directory, it returns nil without error for a fresh install
+func Load(installDir string) (*State, error) {
+	data, err := os.ReadFile(filepath.Join(installDir, Dir, stateFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var s State
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Save records the applied manifest version and release channel, which is empty without channels,
+// and keeps a copy of the manifest including the selected components
+func Save(installDir string, m *manifest.Manifest, components []manifest.Component, channel string) error {
+	dir := filepath.Join(installDir, Dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	applied := *m
+	applied.Components = components
+	if err := writeJSON(filepath.Join(dir, manifestFile), applied); err != nil {
+		return err
+	}
+
+	s := State{
+		Version:     m.Version,
+		Channel:     channel,
+		InstalledAt: time.Now().UTC(),
+	}
+	for _, component := range components {
+		s.Components = append(s.Components, component.Name)
+	}
+	return writeJSON(filepath.Join(dir, stateFile), s)
+}
+
+// writeJSON writes to a temporary file first so an interrupted write never leaves a broken state
+func writeJSON(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,36 @@
+package transaction
+
+import (
+	"io/fs"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/sogladev/go-manifest-patcher/pkg/manifest"
+)
+
+// modeDrifted reports whether the local permission bits differ from the manifest
+func modeDrifted(localMode fs.FileMode, file *manifest.PatchFile) bool {
+	if runtime.GOOS == "windows" {
+		return false
+	}
+	mode, ok := file.FileMode()
+	return ok && mode != localMode
+}
+
+// applyAttributes sets the file mode and modification time recorded in the manifest.
+// Permission bits are ignored on Windows.
+func applyAttributes(path string, file *manifest.PatchFile) error {
+	if mode, ok := file.FileMode(); ok && runtime.GOOS != "windows" {
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+	if file.ModTime > 0 {
+		modTime := time.Unix(file.ModTime, file.ModNano)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
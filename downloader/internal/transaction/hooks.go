@@ -0,0 +1,114 @@
+package transaction
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/sogladev/go-manifest-patcher/pkg/manifest"
+	"github.com/sogladev/go-manifest-patcher/pkg/util"
+)
+
+// hooks returns the post-install hooks that apply to the transaction platform
+func (t *Transaction) hooks(m *manifest.Manifest) []manifest.Hook {
+	var hooks []manifest.Hook
+	for _, hook := range m.Hooks {
+		if hook.AppliesTo(t.goos, t.goarch) {
+			hooks = append(hooks, hook)
+		}
+	}
+	return hooks
+}
+
+func (t *Transaction) printHooks(m *manifest.Manifest) {
+	hooks := t.hooks(m)
+	if len(hooks) == 0 {
+		return
+	}
+
+	switch {
+	case !t.changes(m):
+		fmt.Printf("\n %s\n", util.ColorYellow("Post-install hooks (skipped, nothing to install):"))
+	case t.skipHooks:
+		fmt.Printf("\n %s\n", util.ColorYellow("Post-install hooks (skipped, -skip-hooks is set):"))
+	case !m.Verified:
+		fmt.Printf("\n %s\n", util.ColorYellow("Post-install hooks (skipped, manifest signature is not verified):"))
+	default:
+		fmt.Printf("\n %s\n", util.ColorCyan("Post-install hooks (run after download):"))
+	}
+	for _, hook := range hooks {
+		fmt.Printf("  %s: %s (timeout %s)\n", hook.Name, hook.String(), hook.TimeoutDuration())
+	}
+}
+
+// changes reports whether the transaction installs a different version or changes at least one file
+func (t *Transaction) changes(m *manifest.Manifest) bool {
+	if t.Installed != m.Version {
+		return true
+	}
+	for _, op := range t.Operations {
+		if op.Status != UpToDate && op.Status != Modified {
+			return true
+		}
+	}
+	return false
+}
+
+// RunHooks runs the post-install hooks of the manifest after a successful download.
+// Hooks only run when the transaction changed something, and never when the manifest signature was not verified.
+func (t *Transaction) RunHooks(m *manifest.Manifest) error {
+	hooks := t.hooks(m)
+	if len(hooks) == 0 || t.skipHooks || !t.changes(m) {
+		return nil
+	}
+	if !m.Verified {
+		fmt.Printf("\nSkipping %d post-install hook(s): manifest signature is not verified\n", len(hooks))
+		return nil
+	}
+
+	var failed []string
+	for _, hook := range hooks {
+		fmt.Printf("\nRunning hook %s: %s\n", hook.Name, hook.String())
+		output, err := t.runHook(hook)
+		for _, line := range strings.Split(strings.TrimRight(string(output), "\n"), "\n") {
+			if line != "" {
+				fmt.Printf("  %s\n", line)
+			}
+		}
+		if err != nil {
+			fmt.Println(util.ColorRed(fmt.Sprintf("Hook %s failed: %v", hook.Name, err)))
+			failed = append(failed, hook.Name)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("post-install hooks failed: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// runHook runs a single hook from the install directory and returns its combined output
+func (t *Transaction) runHook(hook manifest.Hook) ([]byte, error) {
+	command, err := t.localPath(hook.Command)
+	if err != nil {
+		return nil, err
+	}
+	command, err = filepath.Abs(command)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hook.TimeoutDuration())
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, command, hook.Args...)
+	cmd.Dir = t.installDir
+	output, err := cmd.CombinedOutput()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return output, fmt.Errorf("timed out after %s", hook.TimeoutDuration())
+	}
+	return output, err
+}
@@ -0,0 +1,153 @@
+package transaction
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+
+	"github.com/sogladev/go-manifest-patcher/downloader/internal/logger"
+	"github.com/sogladev/go-manifest-patcher/pkg/manifest"
+)
+
+// planSymlink compares a symlink entry with the local file system
+func (t *Transaction) planSymlink(file *manifest.PatchFile, component string) (*FileOperation, error) {
+	localPath, err := t.linkPath(file.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	status := Missing
+	if info, err := os.Lstat(localPath); err == nil {
+		status = OutOfDate
+		if info.Mode()&os.ModeSymlink != 0 {
+			if target, err := os.Readlink(localPath); err == nil && filepath.ToSlash(target) == file.Target {
+				status = UpToDate
+			}
+		} else if info.Mode().IsRegular() && runtime.GOOS == "windows" {
+			// Windows without symlink privileges gets a copy of the target instead, see createSymlink
+			status = UpToDate
+		}
+	}
+
+	return &FileOperation{
+		Path:      file.Path,
+		File:      file,
+		Status:    status,
+		Component: component,
+	}, nil
+}
+
+// planDir compares a directory entry with the local file system
+func (t *Transaction) planDir(file *manifest.PatchFile, component string) (*FileOperation, error) {
+	localPath, err := t.localPath(file.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	status := Missing
+	var localMode os.FileMode
+	if info, err := os.Stat(localPath); err == nil {
+		localMode = info.Mode().Perm()
+		if !info.IsDir() {
+			status = OutOfDate
+		} else if modeDrifted(localMode, file) {
+			status = PermissionsChanged
+		} else {
+			status = UpToDate
+		}
+	}
+
+	return &FileOperation{
+		Path:      file.Path,
+		File:      file,
+		Status:    status,
+		Component: component,
+		LocalMode: localMode,
+	}, nil
+}
+
+// linkPath resolves the location of a symlink entry, only its parent directory has to be safe
+// because an existing link at that location is replaced rather than followed
+func (t *Transaction) linkPath(p string) (string, error) {
+	parent, err := t.localPath(path.Dir(p))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, path.Base(p)), nil
+}
+
+// createDir creates a directory entry, replacing a file with the same name
+func (t *Transaction) createDir(op *FileOperation) error {
+	localPath, err := t.localPath(op.Path)
+	if err != nil {
+		return err
+	}
+	if op.Status == OutOfDate {
+		if err := os.Remove(localPath); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(localPath, 0755); err != nil {
+		return err
+	}
+	return applyAttributes(localPath, op.File)
+}
+
+// createSymlink creates a symlink entry. When the platform refuses to create symlinks
+// (e.g. Windows without developer mode) the target file is copied instead.
+func (t *Transaction) createSymlink(op *FileOperation) error {
+	localPath, err := t.linkPath(op.Path)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+	if op.Status == OutOfDate {
+		if err := os.Remove(localPath); err != nil {
+			return err
+		}
+	}
+
+	// The manifest only checks the target lexically, links created earlier may lead elsewhere
+	targetPath, err := manifest.ResolveSymlinkTarget(t.installDir, localPath, op.File.Target)
+	if err != nil {
+		return err
+	}
+
+	err = os.Symlink(filepath.FromSlash(op.File.Target), localPath)
+	if err == nil {
+		return nil
+	}
+
+	logger.Warning.Printf("Could not create symlink %s (%v), copying %s instead", op.Path, err, op.File.Target)
+	return copyFile(targetPath, localPath)
+}
+
+func copyFile(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("cannot copy %s: not a regular file", src)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
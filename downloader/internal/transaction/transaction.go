@@ -1,11 +1,17 @@
 package transaction
 
 import (
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"time"
 
 	"github.com/dustin/go-humanize"
@@ -20,50 +26,175 @@ const (
 	UpToDate Status = iota
 	Missing
 	OutOfDate
+	Modified           // custom file changed by the user, kept as is
+	PermissionsChanged // content is up to date but the file mode differs
 )
 
+// baseComponent is the component name used for files listed directly in the manifest
+const baseComponent = "base"
+
 type FileOperation struct {
-	Path   string
-	Size   int64
-	Hash   string
-	File   *manifest.PatchFile
-	Status Status
+	Path      string
+	Size      int64
+	Hash      string
+	File      *manifest.PatchFile
+	Status    Status
+	Component string
+	LocalMode fs.FileMode
+}
+
+// Options controls how a transaction is planned and applied
+type Options struct {
+	// InstallDir is the directory manifest paths are resolved against
+	InstallDir string
+	// Components are the selected components, installed on top of the base files
+	Components []manifest.Component
+	// ResetCustom overwrites custom files that were modified locally
+	ResetCustom bool
+	// OS and Arch select the platform specific files, they default to the running platform
+	OS   string
+	Arch string
+	// SkipHooks disables the post-install hooks of the manifest
+	SkipHooks bool
+	// InstalledVersion is the manifest version currently installed, empty for a fresh install
+	InstalledVersion string
+	// Client downloads the files, defaults to http.DefaultClient
+	Client *http.Client
 }
 
 type Transaction struct {
-	Operations []*FileOperation
+	Operations  []*FileOperation
+	Components  []string
+	Platform    string
+	Installed   string
+	installDir  string
+	resetCustom bool
+	skipHooks   bool
+	goos        string
+	goarch      string
+	client      *http.Client
 }
 
-func newTransaction() *Transaction {
+func newTransaction(opts Options) *Transaction {
+	installDir := opts.InstallDir
+	if installDir == "" {
+		installDir = "."
+	}
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
 	return &Transaction{
-		Operations: make([]*FileOperation, 0),
+		Operations:  make([]*FileOperation, 0),
+		client:      client,
+		installDir:  installDir,
+		resetCustom: opts.ResetCustom,
+		skipHooks:   opts.SkipHooks,
+		Installed:   opts.InstalledVersion,
 	}
 }
 
-func CreateTransaction(m *manifest.Manifest) *Transaction {
-	transaction := newTransaction()
-	for i, file := range m.Files {
-		var status Status
-		hash, err := manifest.CalculateHashMD5(file.Path)
-		if err == nil {
-			if hash == file.Hash {
-				status = UpToDate
-			} else {
-				status = OutOfDate
+func CreateTransaction(m *manifest.Manifest, opts Options) (*Transaction, error) {
+	transaction := newTransaction(opts)
+
+	goos, goarch := opts.OS, opts.Arch
+	if goos == "" {
+		goos = runtime.GOOS
+	}
+	if goarch == "" {
+		goarch = runtime.GOARCH
+	}
+
+	transaction.Platform = goos + "/" + goarch
+	transaction.goos, transaction.goarch = goos, goarch
+
+	// Base files come first so components cannot silently replace them
+	type fileSet struct {
+		component string
+		files     []manifest.PatchFile
+	}
+	sets := []fileSet{{component: baseComponent, files: m.Files}}
+	for _, component := range opts.Components {
+		sets = append(sets, fileSet{component: component.Name, files: component.Files})
+	}
+
+	// Merge all sets, the same file in two components is fine but different content is a conflict
+	planned := map[string]*FileOperation{}
+	var conflicts []string
+	for _, set := range sets {
+		transaction.Components = append(transaction.Components, set.component)
+		for i := range set.files {
+			file := &set.files[i]
+			if !file.AppliesTo(goos, goarch) {
+				continue
 			}
-		} else {
-			status = Missing
+			key := strings.ToLower(file.Path)
+			if existing, ok := planned[key]; ok {
+				if existing.File.Hash != file.Hash || existing.File.Target != file.Target || existing.File.EntryType() != file.EntryType() {
+					conflicts = append(conflicts, fmt.Sprintf("  %s: %s and %s provide different content",
+						file.Path, existing.Component, set.component))
+				}
+				continue
+			}
+
+			operation, err := transaction.planFile(file, set.component)
+			if err != nil {
+				return nil, err
+			}
+			planned[key] = operation
+			transaction.Operations = append(transaction.Operations, operation)
 		}
-		operation := &FileOperation{
-			Path:   file.Path,
-			Size:   file.Size,
-			Hash:   hash,
-			File:   &m.Files[i],
-			Status: status,
+	}
+	if len(conflicts) > 0 {
+		return nil, fmt.Errorf("conflicting files between components:\n%s", strings.Join(conflicts, "\n"))
+	}
+
+	return transaction, nil
+}
+
+// planFile compares a manifest entry with the local file and decides what to do with it
+func (t *Transaction) planFile(file *manifest.PatchFile, component string) (*FileOperation, error) {
+	switch file.EntryType() {
+	case manifest.TypeSymlink:
+		return t.planSymlink(file, component)
+	case manifest.TypeDir:
+		return t.planDir(file, component)
+	}
+
+	var status Status
+	localPath, err := t.localPath(file.Path)
+	if err != nil {
+		return nil, err
+	}
+	var localMode fs.FileMode
+	hash, err := manifest.CalculateHashMD5(localPath)
+	if err == nil {
+		if info, err := os.Stat(localPath); err == nil {
+			localMode = info.Mode().Perm()
+		}
+		if hash == file.Hash {
+			status = UpToDate
+			if modeDrifted(localMode, file) {
+				status = PermissionsChanged
+			}
+		} else if file.Custom && !t.resetCustom {
+			// Custom files are only installed when missing
+			status = Modified
+		} else {
+			status = OutOfDate
 		}
-		transaction.Operations = append(transaction.Operations, operation)
+	} else {
+		status = Missing
 	}
-	return transaction
+	return &FileOperation{
+		Path:      file.Path,
+		Size:      file.Size,
+		Hash:      hash,
+		File:      file,
+		Status:    status,
+		Component: component,
+		LocalMode: localMode,
+	}, nil
 }
 
 func (t *Transaction) Print(m *manifest.Manifest, localFiles map[string]bool) error {
@@ -73,9 +204,11 @@ func (t *Transaction) Print(m *manifest.Manifest, localFiles map[string]bool) er
 	// Split operations into categories based on Status
 	// Remove Manifest files from localFiles, result are ExtraFiles not in manifest
 	filteredOps := map[Status][]*FileOperation{
-		UpToDate:  {},
-		OutOfDate: {},
-		Missing:   {},
+		UpToDate:           {},
+		OutOfDate:          {},
+		Missing:            {},
+		Modified:           {},
+		PermissionsChanged: {},
 	}
 	for _, op := range t.Operations {
 		filteredOps[op.Status] = append(filteredOps[op.Status], op)
@@ -83,7 +216,21 @@ func (t *Transaction) Print(m *manifest.Manifest, localFiles map[string]bool) er
 	}
 
 	fmt.Println("\nManifest Overview:")
-	fmt.Printf(" Version: %s\n", m.Version)
+	switch t.Installed {
+	case "":
+		fmt.Printf(" Version: %s\n", m.Version)
+	case m.Version:
+		fmt.Printf(" Version: %s (installed)\n", m.Version)
+	default:
+		fmt.Printf(" Updating from %s to %s\n", t.Installed, m.Version)
+	}
+	fmt.Printf(" Platform: %s\n", t.Platform)
+	if len(m.Components) > 0 {
+		fmt.Printf(" Components: %s\n", strings.Join(t.Components, ", "))
+		if available := t.unselectedComponents(m); len(available) > 0 {
+			fmt.Printf(" Available components (not selected): %s\n", strings.Join(available, ", "))
+		}
+	}
 	fmt.Printf(" %s\n", util.ColorGreen("Up-to-date files:"))
 	for _, op := range filteredOps[UpToDate] {
 		fmt.Printf("  %s (Size: %s)\n",
@@ -92,6 +239,21 @@ func (t *Transaction) Print(m *manifest.Manifest, localFiles map[string]bool) er
 		)
 	}
 
+	if len(filteredOps[PermissionsChanged]) > 0 {
+		fmt.Printf("\n %s\n", util.ColorYellow("Permission changes (will be fixed):"))
+		for _, op := range filteredOps[PermissionsChanged] {
+			fmt.Printf("  %s (Mode: %04o -> %s)\n", util.ColorYellow(op.File.Path), op.LocalMode, op.File.Mode)
+		}
+	}
+
+	if len(filteredOps[Modified]) > 0 {
+		fmt.Printf("\n %s\n", util.ColorYellow("Locally modified files (kept, use -reset-custom to overwrite):"))
+		for _, op := range filteredOps[Modified] {
+			fmt.Printf("  %s\n", util.ColorYellow(op.File.Path))
+			logger.Debug.Printf("File: %s, Current Hash: %s, Manifest Hash: %s", op.File.Path, op.Hash, op.File.Hash)
+		}
+	}
+
 	fmt.Printf("\n %s\n", util.ColorYellow("Outdated files (will be updated):"))
 	for _, op := range filteredOps[OutOfDate] {
 		totalDownloadSize += op.File.Size
@@ -119,7 +281,7 @@ func (t *Transaction) Print(m *manifest.Manifest, localFiles map[string]bool) er
 	extraFilesCount := 0
 	for file := range localFiles {
 		if extraFilesCount < 10 {
-			info, _ := os.Stat(file)
+			info, _ := os.Stat(filepath.Join(t.installDir, filepath.FromSlash(file)))
 			fmt.Printf("  %s (Size: %s)\n",
 				util.ColorCyan(file),
 				humanize.Bytes(uint64(info.Size())),
@@ -131,6 +293,8 @@ func (t *Transaction) Print(m *manifest.Manifest, localFiles map[string]bool) er
 		fmt.Printf("  ...and %d more files\n", extraFilesCount-10)
 	}
 
+	t.printHooks(m)
+
 	if len(t.Operations) > 0 {
 		fmt.Printf("\nTransaction Summary:\n")
 		fmt.Printf(" Installing/Updating: %d files\n\n", len(t.Operations))
@@ -150,65 +314,158 @@ func (t *Transaction) Print(m *manifest.Manifest, localFiles map[string]bool) er
 	return nil
 }
 
+// unselectedComponents returns the optional components of m that are not part of the transaction
+func (t *Transaction) unselectedComponents(m *manifest.Manifest) []string {
+	selected := map[string]bool{}
+	for _, name := range t.Components {
+		selected[name] = true
+	}
+	var names []string
+	for _, component := range m.Components {
+		if !selected[component.Name] {
+			names = append(names, component.Name)
+		}
+	}
+	return names
+}
+
 func (t *Transaction) Download(m *manifest.Manifest, localFiles map[string]bool) error {
 	totalFiles := len(t.Operations)
 	currentFile := 0
 
+	// Symlinks are created last so their targets already exist when a copy fallback is needed
+	var symlinks []*FileOperation
 	for _, op := range t.Operations {
-		if op.Status == Missing || op.Status == OutOfDate {
+		if op.File.EntryType() == manifest.TypeSymlink {
+			if op.Status == Missing || op.Status == OutOfDate {
+				symlinks = append(symlinks, op)
+			}
+			continue
+		}
+
+		switch op.Status {
+		case Missing, OutOfDate:
+			if op.File.EntryType() == manifest.TypeDir {
+				if err := t.createDir(op); err != nil {
+					return fmt.Errorf("error creating directory %s: %v", op.Path, err)
+				}
+				continue
+			}
 			currentFile++
-			err := downloadFile(op.File.URL, op.Path, currentFile, totalFiles)
+			localPath, err := t.localPath(op.Path)
 			if err != nil {
-				return fmt.Errorf("error downloading file %s: %v", op.Path, err)
+				return err
 			}
+			err = downloadFile(t.client, op.File, localPath, currentFile, totalFiles)
+			if err != nil {
+				return fmt.Errorf("error downloading file %s: %w", op.Path, err)
+			}
+			if err := applyAttributes(localPath, op.File); err != nil {
+				return fmt.Errorf("error applying attributes to %s: %v", op.Path, err)
+			}
+		case PermissionsChanged:
+			localPath, err := t.localPath(op.Path)
+			if err != nil {
+				return err
+			}
+			if err := applyAttributes(localPath, op.File); err != nil {
+				return fmt.Errorf("error applying attributes to %s: %v", op.Path, err)
+			}
+		}
+	}
+
+	for _, op := range symlinks {
+		if err := t.createSymlink(op); err != nil {
+			return fmt.Errorf("error creating symlink %s: %v", op.Path, err)
 		}
 	}
 
 	return nil
 }
 
-func downloadFile(url, filePath string, fileIndex, totalFiles int) error {
+// localPath converts a manifest path to a path inside the install directory,
+// refusing paths that escape it through symlinks
+func (t *Transaction) localPath(path string) (string, error) {
+	return manifest.ResolvePath(t.installDir, path)
+}
+
+func downloadFile(client *http.Client, file *manifest.PatchFile, filePath string, fileIndex, totalFiles int) error {
 	start := time.Now()
-	resp, err := http.Get(url)
+	req, err := http.NewRequest(http.MethodGet, file.URL, nil)
+	if err != nil {
+		return err
+	}
+	// Requested explicitly, the compressed copy is then decoded below instead of by the transport
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to download file, status code: %d", resp.StatusCode)
+		return fmt.Errorf("failed to download file, %w", manifest.ResponseError(resp))
 	}
+	content, err := decodeContent(resp.Body, resp.Header.Get("Content-Encoding"))
+	if err != nil {
+		return err
+	}
+	defer content.Close()
 
 	dir := filepath.Dir(filePath)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return fmt.Errorf("failed to create directory %s: %v", dir, err)
 	}
 
-	out, err := os.Create(filePath)
+	// Written next to the file first and renamed once the hash matches,
+	// a failed or corrupt download never replaces the file
+	tempPath := filePath + ".tmp"
+	out, err := os.Create(tempPath)
 	if err != nil {
 		return err
 	}
-	defer out.Close()
+	defer os.Remove(tempPath)
 
-	total := resp.ContentLength
+	// Progress counts decoded bytes, the manifest size is known even when the transfer size is not
 	var downloaded int64
-
-	reader := io.TeeReader(resp.Body, &progressWriter{
-		Out:        out,
+	progress := &progressWriter{
 		Downloaded: &downloaded,
-		Total:      total,
+		Total:      file.Size,
 		StartTime:  start,
 		FileIndex:  fileIndex,
 		TotalFiles: totalFiles,
 		FileName:   filepath.Base(filePath),
-	})
+	}
 
-	_, err = io.Copy(io.Discard, reader)
-	return err
+	// The manifest hash is of the uncompressed file
+	hasher := md5.New()
+	_, err = io.Copy(io.MultiWriter(out, hasher, progress), content)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(hasher.Sum(nil)); file.Hash != "" && !strings.EqualFold(actual, file.Hash) {
+		return fmt.Errorf("downloaded file has hash %s, expected %s", actual, file.Hash)
+	}
+	return os.Rename(tempPath, filePath)
+}
+
+// decodeContent undoes the Content-Encoding of a download, only gzip is requested
+func decodeContent(body io.Reader, encoding string) (io.ReadCloser, error) {
+	switch strings.ToLower(encoding) {
+	case "", "identity":
+		return io.NopCloser(body), nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(body)
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
 }
 
+// progressWriter prints the progress of the bytes written to it
 type progressWriter struct {
-	Out        *os.File
 	Downloaded *int64
 	Total      int64
 	StartTime  time.Time
@@ -218,7 +475,7 @@ type progressWriter struct {
 }
 
 func (pw *progressWriter) Write(p []byte) (int, error) {
-	n, err := pw.Out.Write(p)
+	n := len(p)
 	*pw.Downloaded += int64(n)
 	elapsed := time.Since(pw.StartTime)
 	speed := float64(*pw.Downloaded) / elapsed.Seconds()
@@ -233,5 +490,5 @@ func (pw *progressWriter) Write(p []byte) (int, error) {
 		Elapsed:    elapsed,
 		FileName:   pw.FileName,
 	})
-	return n, err
+	return n, nil
 }
@@ -1,15 +1,21 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
+	"slices"
 	"strings"
 
 	"github.com/common-nighthawk/go-figure"
 
 	"github.com/sogladev/go-manifest-patcher/downloader/internal/config"
 	"github.com/sogladev/go-manifest-patcher/downloader/internal/filter"
+	"github.com/sogladev/go-manifest-patcher/downloader/internal/httpclient"
 	"github.com/sogladev/go-manifest-patcher/downloader/internal/logger"
+	"github.com/sogladev/go-manifest-patcher/downloader/internal/state"
 	"github.com/sogladev/go-manifest-patcher/downloader/internal/transaction"
 	"github.com/sogladev/go-manifest-patcher/downloader/updater"
 	"github.com/sogladev/go-manifest-patcher/pkg/manifest"
@@ -52,8 +58,17 @@ func main() {
 		}
 	}
 
+	if cfg.ListChannel {
+		if err := listChannels(cfg); err != nil {
+			fmt.Println("Error:", err)
+			printAuthHint(err, cfg)
+		}
+		return
+	}
+
 	if err := run(cfg); err != nil {
 		fmt.Println("Error:", err)
+		printAuthHint(err, cfg)
 		return
 	}
 
@@ -61,13 +76,102 @@ func main() {
 	println("All files are up to date or successfully downloaded.")
 }
 
+// newLoadOptions returns how manifests are loaded: the HTTP client trusting the configured
+// certificates, strictness and the public key to verify signatures with
+func newLoadOptions(cfg *config.Config, installed *state.State) (manifest.LoadOptions, error) {
+	// Report the installed release for the server statistics
+	header := http.Header{"User-Agent": {"go-manifest-patcher/" + currentVersion}}
+	if installed != nil {
+		header.Set(httpclient.VersionHeader, installed.Version)
+		header.Set(httpclient.ChannelHeader, installed.Channel)
+	} else {
+		header.Set(httpclient.VersionHeader, "")
+	}
+	// Credentials are only sent to the server hosting the manifest
+	var host string
+	if u, err := url.Parse(cfg.ManifestURL); err == nil {
+		host = u.Host
+	}
+	client, err := httpclient.New(httpclient.Options{
+		Header:     header,
+		Host:       host,
+		Token:      cfg.Token,
+		Signed:     cfg.Signed,
+		CAFile:     cfg.CAFile,
+		PinnedCert: cfg.PinnedCert,
+	})
+	if err != nil {
+		return manifest.LoadOptions{}, err
+	}
+
+	loadOptions := manifest.LoadOptions{
+		Strict: cfg.Strict,
+		Client: client,
+	}
+	if cfg.PublicKey != "" {
+		key, err := manifest.LoadPublicKey(cfg.PublicKey)
+		if err != nil {
+			return manifest.LoadOptions{}, fmt.Errorf("error loading public key: %v", err)
+		}
+		loadOptions.PublicKey = key
+	}
+	return loadOptions, nil
+}
+
 func run(cfg *config.Config) error {
+	// Look up the currently installed version
+	installed, err := state.Load(cfg.InstallDir)
+	if err != nil {
+		logger.Warning.Printf("Failed to read installed version: %v", err)
+	}
+	installedVersion := ""
+	if installed != nil {
+		installedVersion = installed.Version
+	}
+
 	// Load manifest from file or URL
-	m, err := manifest.LoadManifest(cfg.ManifestURL)
+	loadOptions, err := newLoadOptions(cfg, installed)
 	if err != nil {
+		return err
+	}
+
+	// Pick the manifest of the release channel, updates stay on the installed channel and
+	// fresh installs use the default channel of the server
+	channel := cfg.Channel
+	if channel == "" && installed != nil {
+		channel = installed.Channel
+	}
+	manifestSource, channel, err := selectChannel(cfg.ManifestURL, channel, loadOptions)
+	if err != nil {
+		return err
+	}
+
+	m, err := manifest.LoadManifest(manifestSource, loadOptions)
+	if err != nil {
+		printAuthHint(err, cfg)
 		logger.Error.Fatalf("Failed to load manifest: %v", err)
 	}
 
+	// Select optional components and load their child manifests, updates keep the installed components
+	// unless -components is given. Components the server no longer offers are dropped.
+	componentNames := cfg.Components
+	if componentNames == nil && installed != nil && installed.Components != nil {
+		componentNames = []string{}
+		for _, name := range installed.Components {
+			if slices.Contains(m.ComponentNames(), name) {
+				componentNames = append(componentNames, name)
+			}
+		}
+	}
+	components, err := m.SelectComponents(componentNames)
+	if err != nil {
+		return err
+	}
+	components, err = manifest.LoadComponents(manifestSource, components, loadOptions)
+	if err != nil {
+		return fmt.Errorf("error loading components: %v", err)
+	}
+
 	// Load filter configuration
 	f, err := filter.LoadFilter("filter.json")
 	if err != nil {
@@ -82,26 +186,137 @@ func run(cfg *config.Config) error {
 	}
 
 	// Load local files
-	localFiles, err := filter.CollectExtraFiles(f)
+	localFiles, err := filter.CollectExtraFiles(f, cfg.InstallDir)
 	if err != nil {
 		return fmt.Errorf("error reading local files: %v", err)
 	}
 
 	// Create transaction and prompt user
-	transaction := transaction.CreateTransaction(m)
+	transaction, err := transaction.CreateTransaction(m, transaction.Options{
+		InstallDir:       cfg.InstallDir,
+		Components:       components,
+		ResetCustom:      cfg.ResetCustom,
+		SkipHooks:        cfg.SkipHooks,
+		InstalledVersion: installedVersion,
+		Client:           loadOptions.Client,
+	})
+	if err != nil {
+		return err
+	}
 	if err := transaction.Print(m, localFiles); err != nil {
 		return err
 	}
+
+	// Show release notes when this is not a reinstall of the same version
+	if installedVersion != m.Version {
+		changelog, err := m.LoadChangelog(manifestSource, loadOptions)
+		if err != nil {
+			logger.Warning.Printf("Failed to load changelog: %v", err)
+		} else if changelog != "" {
+			fmt.Printf("\nRelease notes for %s:\n", m.Version)
+			for _, line := range strings.Split(changelog, "\n") {
+				fmt.Printf(" %s\n", line)
+			}
+			println("")
+		}
+	}
 	if err := prompt.PromptyN("Is this ok [y/N]: "); err != nil {
 		return err
 	}
 
 	// Verify files and download missing or outdated files
 	if err := transaction.Download(m, localFiles); err != nil {
+		printAuthHint(err, cfg)
 		logger.Error.Fatalf("Failed to process manifest: %v", err)
 	}
 
+	// Remember what was installed for the next update
+	if err := state.Save(cfg.InstallDir, m, components, channel); err != nil {
+		logger.Warning.Printf("Failed to save installed version: %v", err)
+	}
+
+	// Run post-install hooks, only reached when every file was downloaded
+	if err := transaction.RunHooks(m); err != nil {
+		return err
+	}
+
 	println("\n" + strings.Repeat("-", 80))
 	println("All files are up to date or successfully downloaded.")
 	return nil
 }
+
+// printAuthHint explains how to get access when err is a request rejected by the server
+func printAuthHint(err error, cfg *config.Config) {
+	var httpErr *manifest.HTTPError
+	if !errors.As(err, &httpErr) {
+		return
+	}
+	switch {
+	case httpErr.StatusCode == http.StatusUnauthorized && cfg.Token == "":
+		fmt.Println("\nThe server requires authentication. Set an access token with -token or the PATCHER_TOKEN environment variable, or use a signed manifest URL.")
+	case httpErr.StatusCode == http.StatusUnauthorized:
+		fmt.Println("\nThe server rejected the access token, check -token or the PATCHER_TOKEN environment variable.")
+	case httpErr.StatusCode == http.StatusForbidden:
+		fmt.Println("\nThe server denied access. A signed manifest URL may have expired, ask for a new one.")
+	}
+}
+
+// selectChannel loads the channel index next to the manifest and returns the manifest location and name of
+// the channel, an empty name selects the default channel. Without a name, a channel index that cannot be
+// loaded or has no default channel leaves the manifest location as it is, servers without channels
+// may answer the index request with anything from 404 to an error page.
+func selectChannel(manifestSource, name string, loadOptions manifest.LoadOptions) (string, string, error) {
+	indexSource, err := manifest.ChannelIndexSource(manifestSource)
+	if err != nil {
+		return "", "", err
+	}
+	index, err := manifest.LoadChannelIndex(indexSource, loadOptions)
+	if err != nil && name == "" {
+		logger.Debug.Printf("No channel index, using the manifest directly: %v", err)
+		return manifestSource, "", nil
+	} else if err != nil {
+		return "", "", err
+	}
+	if name == "" && index.Default == "" {
+		return manifestSource, "", nil
+	}
+	channel, err := index.Find(name)
+	if err != nil {
+		return "", "", err
+	}
+	fmt.Printf("Using release channel: %s\n", channel.Name)
+	source, err := channel.ManifestSource(indexSource)
+	return source, channel.Name, err
+}
+
+// listChannels prints the release channels listed in the channel index next to the manifest
+func listChannels(cfg *config.Config) error {
+	loadOptions, err := newLoadOptions(cfg, nil)
+	if err != nil {
+		return err
+	}
+	indexSource, err := manifest.ChannelIndexSource(cfg.ManifestURL)
+	if err != nil {
+		return err
+	}
+	index, err := manifest.LoadChannelIndex(indexSource, loadOptions)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Available channels:")
+	for _, channel := range index.Channels {
+		line := " " + channel.Name
+		if channel.Version != "" {
+			line += " (" + channel.Version + ")"
+		}
+		if channel.Name == index.Default {
+			line += " [default]"
+		}
+		if channel.Description != "" {
+			line += " - " + channel.Description
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package manifest
+
+import "strings"
+
+// LoadChangelog returns the release notes of the manifest. Inline notes take precedence,
+// otherwise ChangelogURL is fetched, resolved relative to the manifest source.
+func (m *Manifest) LoadChangelog(source string, opts LoadOptions) (string, error) {
+	if m.Changelog != "" || m.ChangelogURL == "" {
+		return m.Changelog, nil
+	}
+
+	location, err := resolveReference(source, m.ChangelogURL)
+	if err != nil {
+		return "", err
+	}
+	data, err := readSource(location, opts.Client)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,125 @@
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ChannelIndexFile is the location of the channel index, relative to the default manifest
+const ChannelIndexFile = "channels/index.json"
+
+// Channel is a release channel such as stable, beta or PTR, with its own manifest
+type Channel struct {
+	Name        string `json:"Name"`
+	Description string `json:"Description,omitempty"`
+	Manifest    string `json:"Manifest"`          // path or URL of the manifest, relative to the index
+	Version     string `json:"Version,omitempty"` // current version, informational
+}
+
+// ChannelIndex lists the release channels offered by a server
+type ChannelIndex struct {
+	Default  string    `json:"Default,omitempty"`
+	Channels []Channel `json:"Channels"`
+}
+
+// ChannelIndexSource returns the location of the channel index next to the default manifest
+func ChannelIndexSource(manifestSource string) (string, error) {
+	return resolveReference(manifestSource, ChannelIndexFile)
+}
+
+// LoadChannelIndex reads a channel index from a file or URL
+func LoadChannelIndex(source string, opts LoadOptions) (*ChannelIndex, error) {
+	data, err := readSource(source, opts.Client)
+	if err != nil {
+		return nil, fmt.Errorf("error loading channel index: %w", err)
+	}
+	var index ChannelIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("error parsing channel index: %v", err)
+	}
+	if err := index.Validate(); err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+// Validate checks that channel names are usable as directory names and unique
+func (idx *ChannelIndex) Validate() error {
+	var problems []string
+	names := map[string]bool{}
+	for i, channel := range idx.Channels {
+		if err := ValidatePath(channel.Name); err != nil || strings.Contains(channel.Name, "/") {
+			problems = append(problems, fmt.Sprintf("channel %d: invalid name %q", i, channel.Name))
+		} else if names[channel.Name] {
+			problems = append(problems, fmt.Sprintf("channel %d: duplicate name %q", i, channel.Name))
+		}
+		names[channel.Name] = true
+		if channel.Manifest == "" {
+			problems = append(problems, fmt.Sprintf("channel %d %q: empty manifest", i, channel.Name))
+		}
+	}
+	if idx.Default != "" && !names[idx.Default] {
+		problems = append(problems, fmt.Sprintf("default channel %q does not exist", idx.Default))
+	}
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// Find returns the channel called name, an empty name selects the default channel
+func (idx *ChannelIndex) Find(name string) (*Channel, error) {
+	if name == "" {
+		name = idx.Default
+	}
+	for i := range idx.Channels {
+		if idx.Channels[i].Name == name {
+			return &idx.Channels[i], nil
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("no channel selected and no default channel, available: %s", strings.Join(idx.Names(), ", "))
+	}
+	return nil, fmt.Errorf("unknown channel %q, available: %s", name, strings.Join(idx.Names(), ", "))
+}
+
+// Names returns the channel names in index order
+func (idx *ChannelIndex) Names() []string {
+	names := make([]string, 0, len(idx.Channels))
+	for _, channel := range idx.Channels {
+		names = append(names, channel.Name)
+	}
+	return names
+}
+
+// ManifestSource resolves the manifest location of a channel, indexSource is where the index was loaded from
+func (c *Channel) ManifestSource(indexSource string) (string, error) {
+	return resolveReference(indexSource, c.Manifest)
+}
+
+// WriteChannelIndex atomically writes the index, channels are kept in the given order
+func WriteChannelIndex(index *ChannelIndex, outputFile string) error {
+	if err := index.Validate(); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(outputFile), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(outputFile, data)
+}
+
+// SetVersion updates the version of the channel called name
+func (idx *ChannelIndex) SetVersion(name, version string) {
+	for i := range idx.Channels {
+		if idx.Channels[i].Name == name {
+			idx.Channels[i].Version = version
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package manifest
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// Component is a named group of files on top of the base manifest, e.g. HD textures or a language pack.
+// Files are listed inline or loaded from a child manifest referenced by Manifest.
+type Component struct {
+	Name        string      `json:"Name"`
+	Description string      `json:"Description,omitempty"`
+	Optional    bool        `json:"Optional,omitempty"`
+	Default     bool        `json:"Default,omitempty"`  // optional component installed when nothing is selected
+	Manifest    string      `json:"Manifest,omitempty"` // path or URL, relative to the root manifest
+	Files       []PatchFile `json:"Files,omitempty"`
+}
+
+// SelectComponents returns the components to install.
+// Required components are always selected. When names is nil the optional components
+// marked as Default are selected, otherwise only the named ones. "all" selects everything.
+func (m *Manifest) SelectComponents(names []string) ([]Component, error) {
+	requested := map[string]bool{}
+	for _, name := range names {
+		requested[name] = true
+	}
+
+	known := map[string]bool{}
+	var selected []Component
+	for _, component := range m.Components {
+		known[component.Name] = true
+		switch {
+		case !component.Optional:
+		case requested["all"]:
+		case names == nil && component.Default:
+		case requested[component.Name]:
+		default:
+			continue
+		}
+		selected = append(selected, component)
+	}
+
+	var unknown []string
+	for _, name := range names {
+		if name != "all" && !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("unknown component(s): %s (available: %s)",
+			strings.Join(unknown, ", "), strings.Join(m.ComponentNames(), ", "))
+	}
+
+	return selected, nil
+}
+
+// ComponentNames returns the names of all components in the manifest
+func (m *Manifest) ComponentNames() []string {
+	names := make([]string, 0, len(m.Components))
+	for _, component := range m.Components {
+		names = append(names, component.Name)
+	}
+	return names
+}
+
+// LoadComponents loads the child manifests referenced by the given components.
+// source is the location of the root manifest, child references are resolved relative to it.
+func LoadComponents(source string, components []Component, opts LoadOptions) ([]Component, error) {
+	loaded := make([]Component, len(components))
+	for i, component := range components {
+		loaded[i] = component
+		if component.Manifest == "" {
+			continue
+		}
+
+		childSource, err := resolveReference(source, component.Manifest)
+		if err != nil {
+			return nil, fmt.Errorf("component %s: %v", component.Name, err)
+		}
+		child, err := LoadManifest(childSource, opts)
+		if err != nil {
+			return nil, fmt.Errorf("component %s: %w", component.Name, err)
+		}
+		if len(child.Components) > 0 {
+			return nil, fmt.Errorf("component %s: nested components are not supported", component.Name)
+		}
+		loaded[i].Files = append(append([]PatchFile{}, component.Files...), child.Files...)
+	}
+	return loaded, nil
+}
+
+// resolveReference resolves ref relative to the location of the root manifest
+func resolveReference(source, ref string) (string, error) {
+	if isURL(ref) {
+		return ref, nil
+	}
+	if isURL(source) {
+		base, err := url.Parse(source)
+		if err != nil {
+			return "", err
+		}
+		refURL, err := url.Parse(ref)
+		if err != nil {
+			return "", err
+		}
+		return base.ResolveReference(refURL).String(), nil
+	}
+	if filepath.IsAbs(ref) {
+		return ref, nil
+	}
+	return filepath.Join(filepath.Dir(source), filepath.FromSlash(ref)), nil
+}
+
+func isURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
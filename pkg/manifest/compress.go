@@ -0,0 +1,167 @@
+package manifest
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CompressedCopy is a pre-compressed copy of a file, stored next to it with Suffix appended
+type CompressedCopy struct {
+	Encoding string // Content-Encoding of the copy
+	Suffix   string
+}
+
+// CompressedCopies lists the supported copies by preference, servers pick the first one a client accepts
+var CompressedCopies = []CompressedCopy{
+	{Encoding: "zstd", Suffix: ".zst"},
+	{Encoding: "gzip", Suffix: ".gz"},
+}
+
+// IsCompressedCopy reports whether path is a pre-compressed copy of a file next to it. Copies are
+// served in place of their file and never get an entry of their own. A copy has the modification time
+// of its file, other files that merely share the name, e.g. an archive shipped next to its content,
+// are published as they are. With compress set the generator owns every such name, so copies left
+// behind by a changed file count as well, they are replaced by GenerateOptions.Compress.
+func IsCompressedCopy(path string, compress bool) bool {
+	for _, c := range CompressedCopies {
+		original, ok := strings.CutSuffix(path, c.Suffix)
+		if !ok || filepath.Base(original) == "" {
+			continue
+		}
+		info, err := os.Stat(original)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		if compress {
+			return true
+		}
+		if copyInfo, err := os.Stat(path); err == nil && copyInfo.ModTime().Equal(info.ModTime()) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressionSample is how much of a file is compressed to decide whether a copy is worth it
+const compressionSample = 1 << 20
+
+// compressFiles writes a gzip copy next to every published file, that is the object when
+// the files are published to an object store
+func (g *generator) compressFiles() error {
+	for _, source := range g.sources {
+		file := &source.files[source.index]
+		if file.Hash == "" {
+			continue
+		}
+
+		path := source.path
+		if g.opts.ObjectsDir != "" {
+			path = filepath.Join(g.opts.ObjectsDir, filepath.FromSlash(ObjectPath(file.Hash)))
+		}
+		written, err := compressFile(path)
+		if err != nil {
+			return fmt.Errorf("error compressing %s: %v", path, err)
+		}
+		if written {
+			g.result.Compressed++
+		}
+	}
+	return nil
+}
+
+// compressFile writes path.gz with the modification time of path. An existing copy with the
+// same modification time is kept. Files saving less than 5% in a sample, such as archives
+// and media, get no copy and lose a stale one.
+func compressFile(path string) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	target := path + ".gz"
+	if copyInfo, err := os.Stat(target); err == nil && copyInfo.ModTime().Equal(info.ModTime()) {
+		return false, nil
+	}
+
+	source, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer source.Close()
+
+	sample, err := compressedSize(io.LimitReader(source, compressionSample))
+	if err != nil {
+		return false, err
+	}
+	if sampled := min(info.Size(), compressionSample); sample >= sampled-sampled/20 {
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		return false, nil
+	}
+	if _, err := source.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	// Write to a temporary file first, the server may be serving the current copy
+	temp, err := os.CreateTemp(filepath.Dir(target), ".compress-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(temp.Name())
+
+	writer, err := gzip.NewWriterLevel(temp, gzip.BestCompression)
+	if err != nil {
+		temp.Close()
+		return false, err
+	}
+	_, err = io.Copy(writer, source)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := os.Chmod(temp.Name(), 0644); err != nil {
+		return false, err
+	}
+	// The copy is only up to date while both times match, see the check above
+	if err := os.Chtimes(temp.Name(), info.ModTime(), info.ModTime()); err != nil {
+		return false, err
+	}
+	if err := os.Rename(temp.Name(), target); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// compressedSize returns the gzip size of the data read from r
+func compressedSize(r io.Reader) (int64, error) {
+	counter := &countingWriter{}
+	writer, err := gzip.NewWriterLevel(counter, gzip.BestCompression)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.Copy(writer, r); err != nil {
+		return 0, err
+	}
+	if err := writer.Close(); err != nil {
+		return 0, err
+	}
+	return counter.n, nil
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,178 @@
+package manifest
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+// FileChange is a file whose content differs between two manifests
+type FileChange struct {
+	Path    string `json:"Path"`
+	OldHash string `json:"OldHash"`
+	NewHash string `json:"NewHash"`
+	OldSize int64  `json:"OldSize"`
+	NewSize int64  `json:"NewSize"`
+}
+
+// FileMove is a file with unchanged content at a new path
+type FileMove struct {
+	From string `json:"From"`
+	To   string `json:"To"`
+	Hash string `json:"Hash"`
+	Size int64  `json:"Size"`
+}
+
+// Diff lists the differences between two manifests
+type Diff struct {
+	OldVersion string       `json:"OldVersion"`
+	NewVersion string       `json:"NewVersion"`
+	Added      []PatchFile  `json:"Added"`
+	Removed    []PatchFile  `json:"Removed"`
+	Changed    []FileChange `json:"Changed"`
+	Moved      []FileMove   `json:"Moved"`
+	// DownloadSize is what a client on the old version downloads, moved files are downloaded again
+	DownloadSize int64 `json:"DownloadSize"`
+	// SizeDelta is the change of the total install size
+	SizeDelta int64 `json:"SizeDelta"`
+}
+
+// DiffManifests compares the files of two manifests.
+// Entries for different platforms are compared separately.
+func DiffManifests(oldManifest, newManifest *Manifest) *Diff {
+	d := &Diff{
+		OldVersion: oldManifest.Version,
+		NewVersion: newManifest.Version,
+		Added:      []PatchFile{},
+		Removed:    []PatchFile{},
+		Changed:    []FileChange{},
+		Moved:      []FileMove{},
+	}
+
+	oldFiles := indexFiles(oldManifest.Files)
+	newFiles := indexFiles(newManifest.Files)
+
+	var added, removed []PatchFile
+	for key, newFile := range newFiles {
+		oldFile, ok := oldFiles[key]
+		if !ok {
+			added = append(added, newFile)
+			continue
+		}
+		if oldFile.Hash != newFile.Hash || oldFile.Target != newFile.Target || oldFile.EntryType() != newFile.EntryType() {
+			d.Changed = append(d.Changed, FileChange{
+				Path:    newFile.Path,
+				OldHash: oldFile.Hash,
+				NewHash: newFile.Hash,
+				OldSize: oldFile.Size,
+				NewSize: newFile.Size,
+			})
+			d.DownloadSize += newFile.Size
+		}
+		d.SizeDelta += newFile.Size - oldFile.Size
+	}
+	for key, oldFile := range oldFiles {
+		if _, ok := newFiles[key]; !ok {
+			removed = append(removed, oldFile)
+		}
+	}
+	sortFiles(added)
+	sortFiles(removed)
+
+	// A removed and an added file with the same content is a move
+	removedByHash := map[string][]int{}
+	for i, file := range removed {
+		if file.Hash != "" {
+			removedByHash[file.Hash] = append(removedByHash[file.Hash], i)
+		}
+	}
+	moved := map[int]bool{}
+	for _, file := range added {
+		d.DownloadSize += file.Size
+		d.SizeDelta += file.Size
+		if candidates := removedByHash[file.Hash]; file.Hash != "" && len(candidates) > 0 {
+			from := removed[candidates[0]]
+			removedByHash[file.Hash] = candidates[1:]
+			moved[candidates[0]] = true
+			d.Moved = append(d.Moved, FileMove{From: from.Path, To: file.Path, Hash: file.Hash, Size: file.Size})
+			continue
+		}
+		d.Added = append(d.Added, file)
+	}
+	for i, file := range removed {
+		d.SizeDelta -= file.Size
+		if !moved[i] {
+			d.Removed = append(d.Removed, file)
+		}
+	}
+
+	sort.Slice(d.Changed, func(i, j int) bool { return d.Changed[i].Path < d.Changed[j].Path })
+	return d
+}
+
+// HasChanges reports whether the manifests differ in any file
+func (d *Diff) HasChanges() bool {
+	return len(d.Added)+len(d.Removed)+len(d.Changed)+len(d.Moved) > 0
+}
+
+// Print writes a human-readable summary of the diff
+func (d *Diff) Print(w io.Writer) {
+	fmt.Fprintf(w, "Manifest diff: %s -> %s\n", d.OldVersion, d.NewVersion)
+
+	fmt.Fprintf(w, "\n Added (%d):\n", len(d.Added))
+	for _, file := range d.Added {
+		fmt.Fprintf(w, "  + %s (Size: %s)\n", file.Path, humanize.Bytes(uint64(file.Size)))
+	}
+
+	fmt.Fprintf(w, "\n Removed (%d):\n", len(d.Removed))
+	for _, file := range d.Removed {
+		fmt.Fprintf(w, "  - %s (Size: %s)\n", file.Path, humanize.Bytes(uint64(file.Size)))
+	}
+
+	fmt.Fprintf(w, "\n Changed (%d):\n", len(d.Changed))
+	for _, change := range d.Changed {
+		fmt.Fprintf(w, "  ~ %s (Size: %s -> %s, Hash: %s -> %s)\n", change.Path,
+			humanize.Bytes(uint64(change.OldSize)), humanize.Bytes(uint64(change.NewSize)),
+			shortHash(change.OldHash), shortHash(change.NewHash))
+	}
+
+	fmt.Fprintf(w, "\n Moved (%d):\n", len(d.Moved))
+	for _, move := range d.Moved {
+		fmt.Fprintf(w, "  > %s -> %s (Size: %s)\n", move.From, move.To, humanize.Bytes(uint64(move.Size)))
+	}
+
+	fmt.Fprintf(w, "\nDownload size: %s\n", humanize.Bytes(uint64(d.DownloadSize)))
+	if d.SizeDelta >= 0 {
+		fmt.Fprintf(w, "Install size change: +%s\n", humanize.Bytes(uint64(d.SizeDelta)))
+	} else {
+		fmt.Fprintf(w, "Install size change: -%s\n", humanize.Bytes(uint64(-d.SizeDelta)))
+	}
+}
+
+// indexFiles keys entries by path and platform so per-platform entries are compared with each other
+func indexFiles(files []PatchFile) map[string]PatchFile {
+	index := make(map[string]PatchFile, len(files))
+	for _, file := range files {
+		index[fileKey(&file)] = file
+	}
+	return index
+}
+
+// fileKey identifies an entry by its path and platform
+func fileKey(file *PatchFile) string {
+	return strings.Join([]string{file.Path, strings.Join(file.OS, ","), strings.Join(file.Arch, ",")}, "|")
+}
+
+func sortFiles(files []PatchFile) {
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 8 {
+		return hash[:8]
+	}
+	return hash
+}
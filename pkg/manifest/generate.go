@@ -1,77 +1,549 @@
 package manifest
 
 import (
+	"crypto/ed25519"
 	"encoding/json"
 	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+
+	"github.com/gobwas/glob"
 )
 
-func GenerateManifest(filesDir, baseURL, version string) error {
+// GenerateOptions describes how a manifest is generated from a directory
+type GenerateOptions struct {
+	// FilesDir is the source root, manifest paths are relative to it
+	FilesDir string
+	// PathPrefix is prepended to every manifest path, e.g. "files/"
+	PathPrefix string
+	// File URLs are BaseURL followed by the path below URLRoot, URLRoot defaults to FilesDir
+	BaseURL string
+	URLRoot string
+	Version string
+	// OutputFile is where the manifest is written, defaults to manifest.json
+	OutputFile string
+	// IncludePatterns and ExcludePatterns are glob patterns matched against manifest paths,
+	// in the same style as the downloader filter. Without include patterns every file is included.
+	IncludePatterns []string
+	ExcludePatterns []string
+	// CustomPatterns are glob patterns for user-customizable files (configs, keybinds).
+	// Matching files are marked Custom and are only installed when missing.
+	CustomPatterns []string
+	// Platforms are trees with platform specific files, laid out like FilesDir.
+	// Their entries are tagged with the OS and Arch of the tree.
+	Platforms []PlatformTree
+	// Hooks are copied into the manifest and run by the downloader after an update
+	Hooks []Hook
+	// Changelog holds the release notes shown before updating
+	Changelog string
+	// SigningKey, when set, writes a detached signature next to the manifest
+	SigningKey ed25519.PrivateKey
+	// Previous is the last generated manifest. Hashes of files with unchanged size
+	// and modification time are reused instead of hashing the file again.
+	Previous *Manifest
+	// Workers is the number of files hashed concurrently, defaults to the number of CPUs
+	Workers int
+	// Lenient skips files that cannot be read and lists them in GenerateResult.Skipped.
+	// By default any such file fails the generation with a *GenerateError listing all of them.
+	Lenient bool
+	// ObjectsDir, when set, is a content-addressed store below URLRoot. Every file is copied
+	// to ObjectsDir/ab/cdef... after its hash and its URL points there instead of at FilesDir.
+	// Objects are never overwritten, so releases can share the store and be cached forever.
+	ObjectsDir string
+	// Compress writes a gzip copy (.gz) next to every published file, or object, that shrinks
+	// by compression. Servers send the copy to clients accepting gzip. Existing copies of files
+	// (.gz and .zst next to a file of the same name) never get an entry of their own.
+	Compress bool
+	// SkipWrite only builds the manifest, it can be written later with WriteManifest
+	SkipWrite bool
+	// Progress, when set, is called for every processed file. Calls are never concurrent.
+	Progress func(ProgressEvent)
+}
+
+// ProgressEvent reports a processed file during manifest generation
+type ProgressEvent struct {
+	Event string `json:"event"` // "hashed", "reused" or "skipped"
+	Path  string `json:"path"`
+	Done  int    `json:"done"`  // files hashed or reused so far
+	Total int    `json:"total"` // files to hash or reuse
+	Error string `json:"error,omitempty"`
+}
+
+// SkippedFile is a file left out of the manifest
+type SkippedFile struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// GenerateError lists every file that could not be added to the manifest
+type GenerateError struct {
+	Problems []SkippedFile
+}
+
+func (e *GenerateError) Error() string {
+	lines := make([]string, 0, len(e.Problems))
+	for _, problem := range e.Problems {
+		lines = append(lines, fmt.Sprintf("  %s: %s", problem.Path, problem.Error))
+	}
+	return fmt.Sprintf("%d file(s) could not be added to the manifest:\n%s", len(e.Problems), strings.Join(lines, "\n"))
+}
+
+// GenerateResult describes a generated manifest
+type GenerateResult struct {
+	Manifest *Manifest
+	Hashed   int // files hashed
+	Reused   int // hashes taken from the previous manifest
+	Stored   int // new objects written to GenerateOptions.ObjectsDir
+	// Compressed counts the gzip copies written with GenerateOptions.Compress
+	Compressed int
+	// Skipped lists the files left out in lenient mode
+	Skipped []SkippedFile
+	// Changes compares the new manifest with GenerateOptions.Previous, nil without a previous manifest
+	Changes *Diff
+}
+
+type generator struct {
+	opts         GenerateOptions
+	customGlobs  []glob.Glob
+	includeGlobs []glob.Glob
+	excludeGlobs []glob.Glob
+	previous     map[string][]PatchFile
+	result       GenerateResult
+	jobs         []hashJob
+	reused       []string
+	sources      []hashJob // every regular file, used to publish objects
+}
+
+// hashJob is a file that still needs to be hashed, files[index] is the entry to fill in
+type hashJob struct {
+	files []PatchFile
+	index int
+	path  string
+}
+
+func GenerateManifest(opts GenerateOptions) (*GenerateResult, error) {
 	var m Manifest
-	m.Version = version
+	m.SchemaVersion = CurrentSchemaVersion
+	m.Version = opts.Version
+	m.Hooks = opts.Hooks
+	m.Changelog = opts.Changelog
 
-	// Walk through all files in the directory recursively
-	err := filepath.WalkDir(filesDir, func(path string, d fs.DirEntry, err error) error {
+	if opts.URLRoot == "" {
+		opts.URLRoot = opts.FilesDir
+	}
+	if opts.OutputFile == "" {
+		opts.OutputFile = "manifest.json"
+	}
+
+	g := &generator{opts: opts}
+	var err error
+	if g.customGlobs, err = compileGlobs(opts.CustomPatterns); err != nil {
+		return nil, err
+	}
+	if g.includeGlobs, err = compileGlobs(opts.IncludePatterns); err != nil {
+		return nil, err
+	}
+	if g.excludeGlobs, err = compileGlobs(opts.ExcludePatterns); err != nil {
+		return nil, err
+	}
+	if opts.Previous != nil {
+		g.previous = map[string][]PatchFile{}
+		for _, file := range opts.Previous.Files {
+			g.previous[file.Path] = append(g.previous[file.Path], file)
+		}
+	}
+
+	// Platform trees may live inside the files directory, they are not common files
+	platformDirs := map[string]bool{}
+	for _, tree := range opts.Platforms {
+		platformDirs[filepath.Clean(tree.Dir)] = true
+	}
+	if opts.ObjectsDir != "" {
+		if urlPath, err := relativePath(opts.URLRoot, opts.ObjectsDir); err != nil || urlPath == ".." || strings.HasPrefix(urlPath, "../") {
+			return nil, fmt.Errorf("objects directory %s is not inside the URL root %s", opts.ObjectsDir, opts.URLRoot)
+		}
+		platformDirs[filepath.Clean(opts.ObjectsDir)] = true
+	}
+
+	common, err := g.walk(opts.FilesDir, nil, platformDirs)
+	if err != nil {
+		return nil, err
+	}
+
+	platformTrees := make([][]PatchFile, len(opts.Platforms))
+	for i := range opts.Platforms {
+		platformTrees[i], err = g.walk(opts.Platforms[i].Dir, &opts.Platforms[i], nil)
 		if err != nil {
-			return err
+			return nil, err
 		}
+	}
 
-		if d.IsDir() {
-			return nil // Skip directories
+	// Hash all trees at once, then drop the entries that could not be hashed
+	g.hashFiles()
+	if opts.ObjectsDir != "" {
+		g.publishObjects()
+	}
+	if len(g.result.Skipped) > 0 && !opts.Lenient {
+		return nil, &GenerateError{Problems: g.result.Skipped}
+	}
+	if opts.Compress {
+		if err := g.compressFiles(); err != nil {
+			return nil, err
 		}
+	}
+	common = withoutUnhashed(common)
+	var platformFiles []PatchFile
+	for _, files := range platformTrees {
+		platformFiles = append(platformFiles, withoutUnhashed(files)...)
+	}
+
+	m.Files, err = mergePlatformFiles(common, platformFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	// Catch problems such as overlapping platform trees before publishing
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+
+	// Write the manifest to a file
+	if !opts.SkipWrite {
+		if _, _, err := WriteManifest(&m, opts.OutputFile, opts.SigningKey); err != nil {
+			return nil, err
+		}
+	}
+
+	g.result.Manifest = &m
+	if opts.Previous != nil {
+		g.result.Changes = DiffManifests(opts.Previous, &m)
+	}
+	return &g.result, nil
+}
+
+// walk collects the entries of a single tree, tree is nil for the common files
+func (g *generator) walk(root string, tree *PlatformTree, skipDirs map[string]bool) ([]PatchFile, error) {
+	var files []PatchFile
+	var jobs, sources []hashJob
 
-		// Get path relative to working directory instead of files directory
-		relPath, err := filepath.Rel(".", path)
+	// Walk through all files in the directory recursively
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
-			fmt.Printf("Error getting relative path for %s: %v\n", path, err)
+			if path == root {
+				return err
+			}
+			g.skip(path, err)
 			return nil
 		}
 
-		// Replace Windows backslashes with forward slashes
-		relPath = strings.ReplaceAll(relPath, "\\", "/")
+		if d.IsDir() && path != root && skipDirs[filepath.Clean(path)] {
+			return filepath.SkipDir
+		}
 
-		info, err := os.Stat(path)
+		// Path relative to the root of the tree, manifest paths add the configured prefix
+		rootPath, err := relativePath(root, path)
 		if err != nil {
-			fmt.Printf("Error getting file info for %s: %v\n", path, err)
+			g.skip(path, err)
 			return nil
 		}
+		relPath := g.opts.PathPrefix + rootPath
 
-		hash, err := CalculateHashMD5(path)
-		if err != nil {
-			fmt.Printf("Error calculating hash for %s: %v\n", path, err)
+		if path != root && !g.included(relPath) {
+			if d.IsDir() && matchesAny(g.excludeGlobs, relPath) {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 
-		patchFile := PatchFile{
-			Path:   relPath,
-			Hash:   hash,
-			Size:   info.Size(),
-			Custom: true,
-			URL:    baseURL + relPath,
+		// Files are downloaded from where they are, which differs from relPath for platform trees
+		urlPath, err := relativePath(g.opts.URLRoot, path)
+		if err != nil || urlPath == ".." || strings.HasPrefix(urlPath, "../") {
+			return fmt.Errorf("%s is not inside the URL root %s", path, g.opts.URLRoot)
 		}
 
-		m.Files = append(m.Files, patchFile)
+		var patchFile PatchFile
+		switch {
+		case d.IsDir():
+			// Only empty directories need an entry, the others are created along with their files
+			if path == root {
+				return nil
+			}
+			entries, err := os.ReadDir(path)
+			if err != nil || len(entries) > 0 {
+				return nil
+			}
+			patchFile = dirEntry(path, relPath)
+
+		case d.Type()&fs.ModeSymlink != 0:
+			patchFile, err = symlinkEntry(path, relPath, rootPath)
+			if err != nil {
+				g.skip(path, err)
+				return nil
+			}
+
+		default:
+			if IsCompressedCopy(path, g.opts.Compress) {
+				return nil
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				g.skip(path, err)
+				return nil
+			}
+
+			patchFile = PatchFile{
+				Path:    relPath,
+				Size:    info.Size(),
+				Custom:  matchesAny(g.customGlobs, relPath),
+				URL:     g.opts.BaseURL + urlPath,
+				ModTime: info.ModTime().Unix(),
+				ModNano: int64(info.ModTime().Nanosecond()),
+			}
+
+			// Windows does not have meaningful permission bits
+			if runtime.GOOS != "windows" {
+				patchFile.Mode = fmt.Sprintf("%04o", info.Mode().Perm())
+			}
+		}
+
+		if tree != nil {
+			tree.tag(&patchFile)
+		}
+		if patchFile.EntryType() == TypeFile {
+			sources = append(sources, hashJob{index: len(files), path: path})
+			if previous, ok := g.reusable(&patchFile); ok {
+				patchFile.Hash = previous.Hash
+				g.reused = append(g.reused, path)
+			} else {
+				jobs = append(jobs, hashJob{index: len(files), path: path})
+			}
+		}
+		files = append(files, patchFile)
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	// files no longer grows, so the jobs can refer to its entries
+	for _, job := range jobs {
+		job.files = files
+		g.jobs = append(g.jobs, job)
+	}
+	for _, source := range sources {
+		source.files = files
+		g.sources = append(g.sources, source)
+	}
+	return files, nil
+}
+
+// skip records a file that cannot be added to the manifest
+func (g *generator) skip(path string, err error) {
+	g.result.Skipped = append(g.result.Skipped, SkippedFile{Path: path, Error: err.Error()})
+	g.progress(ProgressEvent{Event: "skipped", Path: path, Error: err.Error()})
+}
+
+func (g *generator) progress(event ProgressEvent) {
+	if g.opts.Progress == nil {
+		return
+	}
+	event.Done = g.result.Hashed + g.result.Reused
+	event.Total = len(g.jobs) + len(g.reused)
+	g.opts.Progress(event)
+}
+
+// reusable returns the previous entry of a file when its size and modification time did not change.
+// Times are compared to the nanosecond, a file rewritten within the same second is hashed again.
+// Platform entries may have been merged across platforms, so any overlapping platform matches.
+func (g *generator) reusable(file *PatchFile) (PatchFile, bool) {
+	for _, previous := range g.previous[file.Path] {
+		if previous.EntryType() == TypeFile && previous.Hash != "" && platformsOverlap(&previous, file) &&
+			previous.Size == file.Size && previous.ModTime == file.ModTime && previous.ModNano == file.ModNano {
+			return previous, true
+		}
+	}
+	return PatchFile{}, false
+}
+
+// hashFiles hashes the files of all jobs concurrently.
+// Files that cannot be hashed are recorded as skipped and keep an empty hash.
+func (g *generator) hashFiles() {
+	for _, path := range g.reused {
+		g.result.Reused++
+		g.progress(ProgressEvent{Event: "reused", Path: path})
+	}
+
+	workers := g.opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	jobChannel := make(chan hashJob)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobChannel {
+				hash, err := CalculateHashMD5(job.path)
+				mu.Lock()
+				if err != nil {
+					g.skip(job.path, err)
+				} else {
+					job.files[job.index].Hash = hash
+					g.result.Hashed++
+					g.progress(ProgressEvent{Event: "hashed", Path: job.path})
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, job := range g.jobs {
+		jobChannel <- job
+	}
+	close(jobChannel)
+	wg.Wait()
+}
 
+// withoutUnhashed removes regular files whose hash could not be calculated
+func withoutUnhashed(files []PatchFile) []PatchFile {
+	hashed := files[:0]
+	for _, file := range files {
+		if file.EntryType() != TypeFile || file.Hash != "" {
+			hashed = append(hashed, file)
+		}
+	}
+	return hashed
+}
+
+// relativePath returns path relative to root with forward slashes.
+// Both are made absolute first, so an absolute root works with relative paths and the other way around.
+func relativePath(root, path string) (string, error) {
+	absRoot, err := filepath.Abs(root)
 	if err != nil {
-		return err
+		return "", err
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	relPath, err := filepath.Rel(absRoot, absPath)
+	if err != nil {
+		return "", err
 	}
 
-	// Write the manifest to a file
-	outputFile := "manifest.json"
-	err = writeManifest(m, outputFile)
-	return err
+	// Replace Windows backslashes with forward slashes
+	return strings.ReplaceAll(relPath, "\\", "/"), nil
+}
+
+// included applies the include and exclude patterns to a manifest path
+func (g *generator) included(relPath string) bool {
+	if matchesAny(g.excludeGlobs, relPath) {
+		return false
+	}
+	return len(g.includeGlobs) == 0 || matchesAny(g.includeGlobs, relPath)
+}
+
+// dirEntry creates the manifest entry for an empty directory
+func dirEntry(path, relPath string) PatchFile {
+	patchFile := PatchFile{
+		Path: relPath,
+		Type: TypeDir,
+	}
+	if info, err := os.Stat(path); err == nil && runtime.GOOS != "windows" {
+		patchFile.Mode = fmt.Sprintf("%04o", info.Mode().Perm())
+	}
+	return patchFile
+}
+
+// symlinkEntry creates the manifest entry for a symlink, the link must stay inside the tree it was found in
+func symlinkEntry(path, relPath, rootPath string) (PatchFile, error) {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return PatchFile{}, err
+	}
+	patchFile := PatchFile{
+		Path:   relPath,
+		Type:   TypeSymlink,
+		Target: filepath.ToSlash(target),
+	}
+	rootTarget := (&PatchFile{Path: rootPath, Target: patchFile.Target}).TargetPath()
+	if filepath.IsAbs(target) || ValidatePath(rootTarget) != nil {
+		return PatchFile{}, fmt.Errorf("target %s points outside of the files directory", target)
+	}
+	return patchFile, nil
+}
+
+func compileGlobs(patterns []string) ([]glob.Glob, error) {
+	globs := make([]glob.Glob, 0, len(patterns))
+	for _, pattern := range patterns {
+		g, err := glob.Compile(filepath.ToSlash(pattern))
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+		globs = append(globs, g)
+	}
+	return globs, nil
+}
+
+func matchesAny(globs []glob.Glob, path string) bool {
+	for _, g := range globs {
+		if g.Match(path) {
+			return true
+		}
+	}
+	return false
 }
 
-func writeManifest(manifest Manifest, outputFile string) error {
+// WriteManifest writes the manifest and, with a signing key, its detached signature.
+// Both files are replaced atomically. It returns the written data and signature.
+func WriteManifest(manifest *Manifest, outputFile string, signingKey ed25519.PrivateKey) ([]byte, []byte, error) {
 	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(outputFile), 0755); err != nil {
+		return nil, nil, err
+	}
+
+	// An old signature would no longer match, so remove it when not signing
+	if signingKey == nil {
+		if err := os.Remove(outputFile + SignatureSuffix); err != nil && !os.IsNotExist(err) {
+			return nil, nil, err
+		}
+		return data, nil, writeFileAtomic(outputFile, data)
+	}
+
+	signature := Sign(data, signingKey)
+	if err := writeFileAtomic(outputFile+SignatureSuffix, signature); err != nil {
+		return nil, nil, err
+	}
+	return data, signature, writeFileAtomic(outputFile, data)
+}
+
+// writeFileAtomic replaces a file through a temporary file, so readers never see partial content
+func writeFileAtomic(name string, data []byte) error {
+	temp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+"-*")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(temp.Name())
 
-	return os.WriteFile(outputFile, data, 0644)
+	_, err = temp.Write(data)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(temp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), name)
 }
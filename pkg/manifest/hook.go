@@ -0,0 +1,70 @@
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultHookTimeout is used for hooks without a Timeout
+const DefaultHookTimeout = 60 * time.Second
+
+// Hook is a command run after a successful update, e.g. to rebuild a shader cache.
+// Hooks only run for manifests with a verified signature.
+type Hook struct {
+	Name    string   `json:"Name"`
+	Command string   `json:"Command"` // path relative to the install directory
+	Args    []string `json:"Args,omitempty"`
+	Timeout int      `json:"Timeout,omitempty"` // seconds, DefaultHookTimeout when unset
+	OS      []string `json:"OS,omitempty"`
+	Arch    []string `json:"Arch,omitempty"`
+}
+
+// AppliesTo reports whether the hook should run on the given platform
+func (h *Hook) AppliesTo(goos, goarch string) bool {
+	return matchesPlatform(h.OS, goos) && matchesPlatform(h.Arch, goarch)
+}
+
+// TimeoutDuration returns the maximum run time of the hook
+func (h *Hook) TimeoutDuration() time.Duration {
+	if h.Timeout <= 0 {
+		return DefaultHookTimeout
+	}
+	return time.Duration(h.Timeout) * time.Second
+}
+
+// String returns the command line of the hook as shown to the user
+func (h *Hook) String() string {
+	return strings.TrimSpace(h.Command + " " + strings.Join(h.Args, " "))
+}
+
+// LoadHooks reads a JSON list of hooks
+func LoadHooks(path string) ([]Hook, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var hooks []Hook
+	if err := json.Unmarshal(data, &hooks); err != nil {
+		return nil, fmt.Errorf("error parsing hooks %s: %v", path, err)
+	}
+	return hooks, nil
+}
+
+func validateHooks(hooks []Hook) []string {
+	var problems []string
+	for i, hook := range hooks {
+		if hook.Name == "" {
+			problems = append(problems, fmt.Sprintf("hook %d: empty name", i))
+		}
+		if err := ValidatePath(hook.Command); err != nil {
+			problems = append(problems, fmt.Sprintf("hook %d %q: command %q: %v", i, hook.Name, hook.Command, err))
+		}
+		if hook.Timeout < 0 {
+			problems = append(problems, fmt.Sprintf("hook %d %q: negative timeout %d", i, hook.Name, hook.Timeout))
+		}
+	}
+	return problems
+}
@@ -1,68 +1,226 @@
 package manifest
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
+// Entry types, an empty Type is a regular file
+const (
+	TypeFile    = "file"
+	TypeSymlink = "symlink"
+	TypeDir     = "dir"
+)
+
 type PatchFile struct {
-	Path   string `json:"Path"`
-	Hash   string `json:"Hash"`
-	Size   int64  `json:"Size"`
-	Custom bool   `json:"Custom"`
-	URL    string `json:"URL"`
+	Path    string   `json:"Path"`
+	Hash    string   `json:"Hash"`
+	Size    int64    `json:"Size"`
+	Custom  bool     `json:"Custom"`
+	URL     string   `json:"URL"`
+	Mode    string   `json:"Mode,omitempty"`    // octal permission bits, e.g. "0755"
+	ModTime int64    `json:"ModTime,omitempty"` // modification time in Unix seconds
+	ModNano int64    `json:"ModNano,omitempty"` // nanoseconds of the modification time within the second
+	Type    string   `json:"Type,omitempty"`    // TypeFile, TypeSymlink or TypeDir
+	Target  string   `json:"Target,omitempty"`  // symlink target, relative to the directory of the link
+	OS      []string `json:"OS,omitempty"`      // platforms the entry applies to, empty for all
+	Arch    []string `json:"Arch,omitempty"`    // architectures the entry applies to, empty for all
+}
+
+// EntryType returns the type of the entry, defaulting to TypeFile
+func (f *PatchFile) EntryType() string {
+	if f.Type == "" {
+		return TypeFile
+	}
+	return f.Type
+}
+
+// TargetPath returns the manifest path a symlink points to
+func (f *PatchFile) TargetPath() string {
+	return path.Join(path.Dir(f.Path), f.Target)
 }
 
+// FileMode returns the permission bits of the file, ok is false when the manifest does not specify them
+func (f *PatchFile) FileMode() (mode fs.FileMode, ok bool) {
+	if f.Mode == "" {
+		return 0, false
+	}
+	perm, err := strconv.ParseUint(f.Mode, 8, 32)
+	if err != nil {
+		return 0, false
+	}
+	return fs.FileMode(perm).Perm(), true
+}
+
+// CurrentSchemaVersion is the newest manifest schema understood by this build.
+// Manifests without a SchemaVersion are treated as version 1.
+// Version 2 adds symlink and directory entries.
+const CurrentSchemaVersion = 2
+
 type Manifest struct {
-	Version string      `json:"Version"`
-	Files   []PatchFile `json:"Files"`
+	SchemaVersion int         `json:"SchemaVersion,omitempty"`
+	Version       string      `json:"Version"`
+	Files         []PatchFile `json:"Files"`
+	Components    []Component `json:"Components,omitempty"`
+	Hooks         []Hook      `json:"Hooks,omitempty"`
+	Changelog     string      `json:"Changelog,omitempty"`    // release notes shown before updating
+	ChangelogURL  string      `json:"ChangelogURL,omitempty"` // path or URL of release notes, relative to the manifest
+
+	// Verified is set when the manifest signature was checked against LoadOptions.PublicKey
+	Verified bool `json:"-"`
 }
 
-func LoadManifest(source string) (*Manifest, error) {
-	var data []byte
-	var err error
+// LoadOptions controls how a manifest is decoded
+type LoadOptions struct {
+	// Strict rejects unknown fields and schema versions newer than CurrentSchemaVersion
+	Strict bool
+	// PublicKey, when set, requires a valid detached signature next to the manifest
+	PublicKey ed25519.PublicKey
+	// Client downloads manifests from URLs, defaults to http.DefaultClient
+	Client *http.Client
+}
 
-	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+func LoadManifest(source string, opts LoadOptions) (*Manifest, error) {
+	if isURL(source) {
 		fmt.Printf("Downloading manifest from: %s\n", source)
-		data, err = downloadManifestData(source)
 	} else {
 		fmt.Printf("Loading manifest from local file: %s\n", source)
-		data, err = os.ReadFile(source)
 	}
 
+	data, err := readSource(source, opts.Client)
 	if err != nil {
 		return nil, err
 	}
 
-	var manifest Manifest
-	err = json.Unmarshal(data, &manifest)
+	// Verify the signature over the raw bytes before trusting any of the content
+	if opts.PublicKey != nil {
+		signature, err := readSource(source+SignatureSuffix, opts.Client)
+		if err != nil {
+			return nil, fmt.Errorf("error loading manifest signature: %w", err)
+		}
+		if err := Verify(data, signature, opts.PublicKey); err != nil {
+			return nil, err
+		}
+	}
+
+	m, err := ParseManifest(data, opts)
 	if err != nil {
+		return nil, err
+	}
+	m.Verified = opts.PublicKey != nil
+	return m, nil
+}
+
+func readSource(source string, client *http.Client) ([]byte, error) {
+	if isURL(source) {
+		return downloadManifestData(source, client)
+	}
+	return os.ReadFile(source)
+}
+
+// ParseManifest decodes and validates manifest data
+func ParseManifest(data []byte, opts LoadOptions) (*Manifest, error) {
+	// Peek at the schema version first so newer manifests can be handled gracefully
+	var header struct {
+		SchemaVersion int `json:"SchemaVersion"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, fmt.Errorf("error parsing manifest: %v", err)
+	}
+
+	newerSchema := header.SchemaVersion > CurrentSchemaVersion
+	if newerSchema {
+		if opts.Strict {
+			return nil, fmt.Errorf("manifest schema version %d is not supported (newest supported: %d)",
+				header.SchemaVersion, CurrentSchemaVersion)
+		}
+		fmt.Printf("Warning: manifest schema version %d is newer than supported version %d, unknown fields are ignored\n",
+			header.SchemaVersion, CurrentSchemaVersion)
+	}
+
+	var manifest Manifest
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if opts.Strict && !newerSchema {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(&manifest); err != nil {
 		return nil, fmt.Errorf("error parsing manifest: %v", err)
 	}
 
 	// Convert Windows-style paths to cross-platform paths
-	for i := range manifest.Files {
-		manifest.Files[i].Path = filepath.ToSlash(manifest.Files[i].Path)
+	normalizePaths(manifest.Files)
+	for i := range manifest.Components {
+		normalizePaths(manifest.Components[i].Files)
+	}
+
+	if err := manifest.Validate(); err != nil {
+		return nil, err
 	}
 
 	return &manifest, nil
 }
 
-func downloadManifestData(url string) ([]byte, error) {
-	resp, err := http.Get(url)
+func normalizePaths(files []PatchFile) {
+	for i := range files {
+		files[i].Path = filepath.ToSlash(files[i].Path)
+		files[i].Target = filepath.ToSlash(files[i].Target)
+	}
+}
+
+func downloadManifestData(url string, client *http.Client) ([]byte, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Get(url)
 	if err != nil {
 		return nil, fmt.Errorf("error fetching manifest: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to fetch manifest, status code: %d", resp.StatusCode)
+		return nil, fmt.Errorf("failed to fetch manifest, %w", ResponseError(resp))
 	}
 
 	return io.ReadAll(resp.Body)
 }
+
+// HTTPError is an unexpected response from the patch server
+type HTTPError struct {
+	StatusCode int
+	// Message is the reason given by the server, if it sent one as plain text
+	Message string
+}
+
+// ResponseError reads the reason of a failed response
+func ResponseError(resp *http.Response) *HTTPError {
+	err := &HTTPError{StatusCode: resp.StatusCode}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		err.Message, _, _ = strings.Cut(strings.TrimSpace(string(body)), "\n")
+	}
+	return err
+}
+
+func (e *HTTPError) Error() string {
+	text := fmt.Sprintf("status code: %d", e.StatusCode)
+	switch e.StatusCode {
+	case http.StatusUnauthorized:
+		text = "authentication required (" + text + ")"
+	case http.StatusForbidden:
+		text = "access denied (" + text + ")"
+	}
+	if e.Message != "" {
+		text += ": " + e.Message
+	}
+	return text
+}
@@ -0,0 +1,94 @@
+package manifest
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ObjectPath returns the path of a payload in a content-addressed store, e.g. "ab/cdef..."
+func ObjectPath(hash string) string {
+	hash = strings.ToLower(hash)
+	return hash[:2] + "/" + hash[2:]
+}
+
+// publishObjects copies every hashed file into the object store and points its URL at the object.
+// Files that cannot be published are recorded as skipped and lose their hash.
+func (g *generator) publishObjects() {
+	for _, source := range g.sources {
+		file := &source.files[source.index]
+		if file.Hash == "" {
+			continue
+		}
+
+		objectFile := filepath.Join(g.opts.ObjectsDir, filepath.FromSlash(ObjectPath(file.Hash)))
+		stored, err := storeObject(source.path, objectFile, file.Hash)
+		if err != nil {
+			file.Hash = ""
+			g.skip(source.path, err)
+			continue
+		}
+		if stored {
+			g.result.Stored++
+		}
+
+		urlPath, err := relativePath(g.opts.URLRoot, objectFile)
+		if err != nil {
+			file.Hash = ""
+			g.skip(source.path, err)
+			continue
+		}
+		file.URL = g.opts.BaseURL + urlPath
+	}
+}
+
+// storeObject copies path to objectFile unless the object already exists.
+// Objects are never modified once written, so a file changed since hashing is an error.
+func storeObject(path, objectFile, hash string) (bool, error) {
+	if _, err := os.Stat(objectFile); err == nil {
+		return false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(objectFile), 0755); err != nil {
+		return false, err
+	}
+	source, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer source.Close()
+
+	// Write to a temporary file first, other releases may publish the same object concurrently
+	temp, err := os.CreateTemp(filepath.Dir(objectFile), ".object-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(temp.Name())
+
+	hasher := md5.New()
+	_, err = io.Copy(io.MultiWriter(temp, hasher), source)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+	if actual := hex.EncodeToString(hasher.Sum(nil)); !strings.EqualFold(actual, hash) {
+		return false, fmt.Errorf("file changed while generating the manifest (hash %s, expected %s)", actual, hash)
+	}
+	if err := os.Chmod(temp.Name(), 0644); err != nil {
+		return false, err
+	}
+	if err := os.Rename(temp.Name(), objectFile); err != nil {
+		// Another release may have stored the same object in the meantime
+		if _, statErr := os.Stat(objectFile); statErr == nil {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
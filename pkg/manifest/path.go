@@ -0,0 +1,149 @@
+package manifest
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrUnsafePath = errors.New("unsafe path")
+
+// Reserved device names on Windows, matched case-insensitively against the part before the first dot
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// ValidatePath checks that a manifest path is relative and cannot leave the install directory.
+// Paths are checked the same way on every platform, so a manifest that is safe on Linux is also safe on Windows.
+func ValidatePath(p string) error {
+	if p == "" {
+		return fmt.Errorf("%w: empty path", ErrUnsafePath)
+	}
+	if strings.ContainsRune(p, 0) {
+		return fmt.Errorf("%w: contains NUL byte", ErrUnsafePath)
+	}
+
+	// Treat backslashes as separators regardless of the current OS
+	normalized := strings.ReplaceAll(p, "\\", "/")
+	if strings.HasPrefix(normalized, "/") {
+		return fmt.Errorf("%w: absolute path", ErrUnsafePath)
+	}
+	if len(normalized) >= 2 && normalized[1] == ':' && isASCIILetter(normalized[0]) {
+		return fmt.Errorf("%w: contains drive letter", ErrUnsafePath)
+	}
+	if strings.Contains(normalized, ":") {
+		return fmt.Errorf("%w: contains ':'", ErrUnsafePath)
+	}
+
+	for _, segment := range strings.Split(normalized, "/") {
+		if segment == ".." {
+			return fmt.Errorf("%w: contains '..' segment", ErrUnsafePath)
+		}
+		name := strings.ToUpper(strings.TrimRight(segment, " ."))
+		if i := strings.Index(name, "."); i >= 0 {
+			name = name[:i]
+		}
+		if windowsReservedNames[name] {
+			return fmt.Errorf("%w: reserved Windows name %q", ErrUnsafePath, segment)
+		}
+	}
+	return nil
+}
+
+// ResolvePath joins a manifest path to root and makes sure that no existing symlink
+// along the way points outside of root.
+func ResolvePath(root, p string) (string, error) {
+	if err := ValidatePath(p); err != nil {
+		return "", err
+	}
+
+	full := filepath.Join(root, filepath.FromSlash(p))
+
+	// Nothing inside a missing root can be a symlink yet
+	if _, err := os.Lstat(root); os.IsNotExist(err) {
+		return full, nil
+	}
+
+	rootReal, err := realPath(root)
+	if err != nil {
+		return "", err
+	}
+
+	// Find the deepest part of the path that already exists, only that part can contain symlinks
+	existing := full
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		existing = parent
+	}
+
+	// A dangling symlink could still be followed when the file is created, so reject it
+	existingAbs, err := filepath.Abs(existing)
+	if err != nil {
+		return "", err
+	}
+	existingReal, err := filepath.EvalSymlinks(existingAbs)
+	if err != nil {
+		return "", fmt.Errorf("%w: cannot resolve %s: %v", ErrUnsafePath, p, err)
+	}
+
+	rel, err := filepath.Rel(rootReal, existingReal)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %s resolves outside of %s", ErrUnsafePath, p, root)
+	}
+	return full, nil
+}
+
+// ResolveSymlinkTarget returns the path that a symlink created at linkPath below root with target would
+// point to, making sure it stays inside root. Unlike the lexical check of the manifest it follows the
+// symlinks already on disk, so links cannot be chained to leave root, e.g. "x" -> "." and "x/r" -> "..".
+func ResolveSymlinkTarget(root, linkPath, target string) (string, error) {
+	if target == "" || filepath.IsAbs(target) || strings.HasPrefix(filepath.ToSlash(target), "/") {
+		return "", fmt.Errorf("%w: symlink target %q is not relative", ErrUnsafePath, target)
+	}
+	rootReal, err := realPath(root)
+	if err != nil {
+		return "", err
+	}
+	parentReal, err := realPath(filepath.Dir(linkPath))
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(rootReal, filepath.Join(parentReal, filepath.FromSlash(target)))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: symlink %s to %s resolves outside of %s", ErrUnsafePath, linkPath, target, root)
+	}
+	// The target may already contain symlinks of its own
+	return ResolvePath(root, filepath.ToSlash(rel))
+}
+
+// realPath returns the absolute path with all symlinks evaluated, or the absolute path if it does not exist
+func realPath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return abs, nil
+		}
+		return "", err
+	}
+	return resolved, nil
+}
+
+func isASCIILetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
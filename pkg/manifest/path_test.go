@@ -0,0 +1,200 @@
+package manifest
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidatePath(t *testing.T) {
+	tests := []struct {
+		path string
+		safe bool
+	}{
+		{"files/a.txt", true},
+		{"a", true},
+		{"dir/sub/file.bin", true},
+		{".hidden/config", true},
+		{"a..b/c", true},
+		{"console.txt", true},
+		{"COM10", true},
+		{"files\\win\\style.txt", true},
+
+		{"", false},
+		{"a\x00b", false},
+
+		// Absolute paths
+		{"/etc/passwd", false},
+		{"\\Windows\\System32", false},
+		{"//server/share/file", false},
+
+		// Drive letters and alternate data streams
+		{"C:/Windows/win.ini", false},
+		{"c:evil.exe", false},
+		{"C:\\Windows\\win.ini", false},
+		{"files/a.txt:stream", false},
+		{"files/a.txt::$DATA", false},
+
+		// Parent directory segments
+		{"..", false},
+		{"../x", false},
+		{"a/../../x", false},
+		{"a/..", false},
+		{"a\\..\\..\\x", false},
+
+		// Reserved Windows names, with extensions, trailing dots and spaces, in any case
+		{"CON", false},
+		{"con.txt", false},
+		{"files/nul", false},
+		{"aux.tar.gz", false},
+		{"COM1 ", false},
+		{"LPT9.", false},
+		{"prn. ", false},
+		{"files/Com3.log/x", false},
+	}
+	for _, tt := range tests {
+		err := ValidatePath(tt.path)
+		if tt.safe && err != nil {
+			t.Errorf("ValidatePath(%q) = %v, want nil", tt.path, err)
+		}
+		if !tt.safe && !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("ValidatePath(%q) = %v, want ErrUnsafePath", tt.path, err)
+		}
+	}
+}
+
+func TestValidateListsUnsafePaths(t *testing.T) {
+	m := &Manifest{Files: []PatchFile{
+		{Path: "ok", Type: TypeDir},
+		{Path: "../escape", Type: TypeDir},
+		{Path: "ok/sub", Type: TypeDir},
+		{Path: "C:/drive", Type: TypeDir},
+	}}
+	var validationErr *ValidationError
+	if err := m.Validate(); !errors.As(err, &validationErr) {
+		t.Fatalf("Validate() = %v, want *ValidationError", err)
+	}
+	if len(validationErr.Problems) != 2 ||
+		!strings.Contains(validationErr.Problems[0], `"../escape"`) ||
+		!strings.Contains(validationErr.Problems[1], `"C:/drive"`) {
+		t.Errorf("Validate() problems = %q, want the two unsafe paths", validationErr.Problems)
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	outside := filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(root, "real"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	links := map[string]string{
+		"inner":           filepath.Join(root, "real"),
+		"relative-inner":  "real",
+		"escape":          outside,
+		"relative-escape": filepath.Join("..", "outside"),
+		"secret":          filepath.Join(outside, "secret"),
+		"dangling":        filepath.Join(root, "missing"),
+		"dangling-escape": filepath.Join(outside, "missing"),
+		"real/up":         "..",
+		"real/up-escape":  filepath.Join("..", ".."),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, filepath.FromSlash(name))); err != nil {
+			t.Skipf("symlinks are not supported: %v", err)
+		}
+	}
+
+	tests := []struct {
+		path string
+		safe bool
+	}{
+		{"real", true},
+		{"real/new/file", true},
+		{"missing/dir/file", true},
+		{"inner/file", true},
+		{"relative-inner/file", true},
+		{"real/up/real/file", true},
+
+		{"escape", false},
+		{"escape/file", false},
+		{"escape/new/dir/file", false},
+		{"relative-escape/file", false},
+		{"secret", false},
+		{"dangling", false},
+		{"dangling-escape", false},
+		{"real/up-escape/file", false},
+		{"../outside/secret", false},
+		{"/etc/passwd", false},
+	}
+	for _, tt := range tests {
+		resolved, err := ResolvePath(root, tt.path)
+		if tt.safe {
+			if want := filepath.Join(root, filepath.FromSlash(tt.path)); err != nil || resolved != want {
+				t.Errorf("ResolvePath(%q) = %q, %v, want %q", tt.path, resolved, err, want)
+			}
+		} else if !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("ResolvePath(%q) = %q, %v, want ErrUnsafePath", tt.path, resolved, err)
+		}
+	}
+}
+
+func TestResolvePathMissingRoot(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "missing")
+	resolved, err := ResolvePath(root, "files/a.txt")
+	if want := filepath.Join(root, "files", "a.txt"); err != nil || resolved != want {
+		t.Errorf("ResolvePath() = %q, %v, want %q", resolved, err, want)
+	}
+}
+
+func TestResolveSymlinkTarget(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	if err := os.MkdirAll(filepath.Join(root, "real", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Each link passes the lexical check of the manifest on its own
+	for name, target := range map[string]string{"self": ".", "deep": filepath.Join("real", "sub")} {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Skipf("symlinks are not supported: %v", err)
+		}
+	}
+
+	tests := []struct {
+		link   string
+		target string
+		want   string // below root, empty when the target is unsafe
+	}{
+		{"a", "real", "real"},
+		{"real/a", "..", "."},
+		{"real/sub/a", "../../real", "real"},
+		{"deep/a", "..", "real"},
+		{"self/a", "real", "real"},
+
+		{"a", "..", ""},
+		{"a", "/etc", ""},
+		{"a", "", ""},
+		{"real/a", "../..", ""},
+		{"self/a", "..", ""},
+		{"deep/a", "../../..", ""},
+	}
+	for _, tt := range tests {
+		linkPath := filepath.Join(root, filepath.FromSlash(tt.link))
+		resolved, err := ResolveSymlinkTarget(root, linkPath, tt.target)
+		if tt.want == "" {
+			if !errors.Is(err, ErrUnsafePath) {
+				t.Errorf("ResolveSymlinkTarget(%q, %q) = %q, %v, want ErrUnsafePath", tt.link, tt.target, resolved, err)
+			}
+		} else if want := filepath.Join(root, tt.want); err != nil || resolved != want {
+			t.Errorf("ResolveSymlinkTarget(%q, %q) = %q, %v, want %q", tt.link, tt.target, resolved, err, want)
+		}
+	}
+}
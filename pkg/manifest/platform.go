@@ -0,0 +1,96 @@
+package manifest
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// PlatformTree is a directory with files for a single platform, e.g. the Linux build
+type PlatformTree struct {
+	OS   string // GOOS value, e.g. "linux" or "windows"
+	Arch string // GOARCH value, e.g. "amd64", empty for any architecture
+	Dir  string
+}
+
+// ParsePlatformTree parses "os/arch=dir" or "os=dir"
+func ParsePlatformTree(value string) (PlatformTree, error) {
+	platform, dir, ok := strings.Cut(value, "=")
+	if !ok || platform == "" || dir == "" {
+		return PlatformTree{}, fmt.Errorf("invalid platform tree %q, expected os/arch=dir", value)
+	}
+	goos, goarch, _ := strings.Cut(platform, "/")
+	return PlatformTree{OS: goos, Arch: goarch, Dir: dir}, nil
+}
+
+func (t *PlatformTree) tag(file *PatchFile) {
+	if t.OS != "" {
+		file.OS = []string{t.OS}
+	}
+	if t.Arch != "" {
+		file.Arch = []string{t.Arch}
+	}
+}
+
+// AppliesTo reports whether the entry should be installed on the given platform.
+// Entries without constraints apply to every platform.
+func (f *PatchFile) AppliesTo(goos, goarch string) bool {
+	return matchesPlatform(f.OS, goos) && matchesPlatform(f.Arch, goarch)
+}
+
+func matchesPlatform(allowed []string, value string) bool {
+	return len(allowed) == 0 || slices.Contains(allowed, value)
+}
+
+// platformsOverlap reports whether two entries can be installed on the same platform
+func platformsOverlap(a, b *PatchFile) bool {
+	return listsOverlap(a.OS, b.OS) && listsOverlap(a.Arch, b.Arch)
+}
+
+func listsOverlap(a, b []string) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return true
+	}
+	for _, value := range a {
+		if slices.Contains(b, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergePlatformFiles combines the common files with the entries of all platform trees.
+// Identical entries from several platforms are collapsed into one entry listing all of them.
+func mergePlatformFiles(common, platformFiles []PatchFile) ([]PatchFile, error) {
+	commonPaths := map[string]bool{}
+	for _, file := range common {
+		commonPaths[strings.ToLower(file.Path)] = true
+	}
+
+	merged := append([]PatchFile{}, common...)
+	collapsed := map[string]int{}
+	var conflicts []string
+	for _, file := range platformFiles {
+		if commonPaths[strings.ToLower(file.Path)] {
+			conflicts = append(conflicts, fmt.Sprintf("  %s is both a common and a platform specific file", file.Path))
+			continue
+		}
+
+		key := strings.Join([]string{file.Path, file.EntryType(), file.Hash, file.Target, strings.Join(file.Arch, ",")}, "|")
+		if i, ok := collapsed[key]; ok {
+			merged[i].OS = append(merged[i].OS, file.OS...)
+			continue
+		}
+		collapsed[key] = len(merged)
+		merged = append(merged, file)
+	}
+	if len(conflicts) > 0 {
+		return nil, fmt.Errorf("conflicting platform files:\n%s", strings.Join(conflicts, "\n"))
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].Path < merged[j].Path
+	})
+	return merged, nil
+}
@@ -0,0 +1,78 @@
+package manifest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// SignatureSuffix is appended to the manifest location to find its detached signature
+const SignatureSuffix = ".sig"
+
+var ErrInvalidSignature = errors.New("invalid manifest signature")
+
+// GenerateKeyPair writes a new ed25519 key pair as base64 to privatePath and publicPath
+func GenerateKeyPair(privatePath, publicPath string) error {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(privatePath, []byte(base64.StdEncoding.EncodeToString(privateKey)+"\n"), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(publicPath, []byte(base64.StdEncoding.EncodeToString(publicKey)+"\n"), 0644)
+}
+
+// LoadPrivateKey reads a base64 encoded ed25519 private key
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	key, err := readKey(path, ed25519.PrivateKeySize)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.PrivateKey(key), nil
+}
+
+// LoadPublicKey reads a base64 encoded ed25519 public key
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	key, err := readKey(path, ed25519.PublicKeySize)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+func readKey(path string, size int) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding key %s: %v", path, err)
+	}
+	if len(key) != size {
+		return nil, fmt.Errorf("key %s has size %d, expected %d", path, len(key), size)
+	}
+	return key, nil
+}
+
+// Sign returns the base64 encoded signature of the raw manifest data
+func Sign(data []byte, key ed25519.PrivateKey) []byte {
+	return []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(key, data)) + "\n")
+}
+
+// Verify checks a base64 encoded signature of the raw manifest data
+func Verify(data, signature []byte, key ed25519.PublicKey) error {
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	if !ed25519.Verify(key, data, sig) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package manifest
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	md5HashRegex = regexp.MustCompile(`^[0-9a-fA-F]{32}$`)
+	modeRegex    = regexp.MustCompile(`^0?[0-7]{3,4}$`)
+)
+
+// ValidationError lists every problem found in a manifest
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("manifest is invalid (%d problem(s)):\n  %s", len(e.Problems), strings.Join(e.Problems, "\n  "))
+}
+
+// Validate checks the manifest for problems that would otherwise only show up while downloading.
+// All problems are reported at once as a *ValidationError.
+func (m *Manifest) Validate() error {
+	var problems []string
+	addProblem := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if m.SchemaVersion < 0 {
+		addProblem("invalid schema version %d", m.SchemaVersion)
+	}
+
+	problems = append(problems, validateFiles("file", m.Files)...)
+
+	componentNames := map[string]bool{}
+	for i, component := range m.Components {
+		if component.Name == "" {
+			addProblem("component %d: empty name", i)
+		} else if componentNames[component.Name] {
+			addProblem("component %d: duplicate name %q", i, component.Name)
+		}
+		componentNames[component.Name] = true
+		problems = append(problems, validateFiles(fmt.Sprintf("component %q file", component.Name), component.Files)...)
+	}
+
+	problems = append(problems, validateHooks(m.Hooks)...)
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// validateFiles checks a single file list, label prefixes every reported problem
+func validateFiles(label string, files []PatchFile) []string {
+	var problems []string
+	addProblem := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	// Paths that only differ in case collide on case-insensitive file systems.
+	// The same path may appear more than once for different platforms.
+	seen := map[string][]int{}
+	for i, file := range files {
+		if err := ValidatePath(file.Path); err != nil {
+			addProblem("%s %d %q: %v", label, i, file.Path, err)
+		}
+		key := strings.ToLower(file.Path)
+		for _, previous := range seen[key] {
+			if platformsOverlap(&files[previous], &files[i]) {
+				addProblem("%s %d %q: duplicate of %q", label, i, file.Path, files[previous].Path)
+				break
+			}
+		}
+		seen[key] = append(seen[key], i)
+		switch file.EntryType() {
+		case TypeFile:
+			if file.Size < 0 {
+				addProblem("%s %d %q: negative size %d", label, i, file.Path, file.Size)
+			}
+			if !md5HashRegex.MatchString(file.Hash) {
+				addProblem("%s %d %q: malformed hash %q", label, i, file.Path, file.Hash)
+			}
+			if strings.TrimSpace(file.URL) == "" {
+				addProblem("%s %d %q: empty URL", label, i, file.Path)
+			}
+		case TypeSymlink:
+			if file.Target == "" {
+				addProblem("%s %d %q: symlink without target", label, i, file.Path)
+			} else if err := ValidatePath(file.TargetPath()); err != nil || strings.HasPrefix(file.Target, "/") {
+				addProblem("%s %d %q: symlink target %q points outside of the install directory", label, i, file.Path, file.Target)
+			}
+		case TypeDir:
+		default:
+			addProblem("%s %d %q: unknown type %q", label, i, file.Path, file.Type)
+		}
+		if file.Mode != "" && !modeRegex.MatchString(file.Mode) {
+			addProblem("%s %d %q: malformed mode %q", label, i, file.Path, file.Mode)
+		}
+		if file.ModTime < 0 {
+			addProblem("%s %d %q: negative modification time %d", label, i, file.Path, file.ModTime)
+		}
+		if file.ModNano < 0 || file.ModNano >= int64(time.Second) {
+			addProblem("%s %d %q: nanoseconds %d out of range", label, i, file.Path, file.ModNano)
+		}
+	}
+	return problems
+}
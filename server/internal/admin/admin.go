@@ -0,0 +1,517 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sogladev/go-manifest-patcher/pkg/manifest"
+)
+
+// Release states
+const (
+	StatusUploaded = "uploaded" // files uploaded, no manifest yet
+	StatusStaged   = "staged"   // manifest generated and signed, downloadable for testing at its own URL
+	StatusLive     = "live"     // promoted, its manifest is the one clients download
+)
+
+// stateFile records the live release and the rollback history, hidden files are never served
+const stateFile = ".releases.json"
+
+// Options configures the admin API
+type Options struct {
+	// Dir holds one directory per release with the uploaded files and the staged manifest.
+	// It must be inside Generate.URLRoot, so the files of a release can be downloaded.
+	Dir string
+	// Generate describes the manifests, FilesDir, OutputFile and Version are set for every release
+	Generate manifest.GenerateOptions
+	// LiveFile is the manifest downloaded by clients, promoted releases are written there
+	LiveFile string
+	// MaxUpload is the largest accepted request body in bytes, 0 for unlimited
+	MaxUpload int64
+	// Publish is called with the new live manifest and its signature, which is nil for unsigned manifests
+	Publish func(m *manifest.Manifest, data, signature []byte)
+}
+
+// Release describes an uploaded release
+type Release struct {
+	Version string `json:"version"`
+	Status  string `json:"status"`
+	// ManifestURL is where testers can download a staged release before it is promoted
+	ManifestURL string `json:"manifest_url,omitempty"`
+	Files       int    `json:"files,omitempty"`
+	// Previous marks releases that were live before, the most recent one is the rollback target
+	Previous bool `json:"previous,omitempty"`
+}
+
+// state is the content of stateFile
+type state struct {
+	Live    string   `json:"live"`
+	History []string `json:"history"` // releases that were live before, the most recent last
+}
+
+// API uploads, stages, promotes and rolls back releases
+type API struct {
+	opts Options
+	// Uploads run concurrently, everything changing manifests or the state runs alone
+	mu sync.RWMutex
+}
+
+var versionPattern = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z._+-]{0,63}$`)
+
+// New creates the API for opts
+func New(opts Options) (*API, error) {
+	if opts.Generate.URLRoot == "" {
+		opts.Generate.URLRoot = "."
+	}
+	// Absolute paths let an absolute URL root be combined with a relative releases directory
+	urlRoot, err := filepath.Abs(opts.Generate.URLRoot)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := filepath.Abs(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	opts.Generate.URLRoot, opts.Dir = urlRoot, dir
+	rel, err := filepath.Rel(urlRoot, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("releases directory %s is not inside the URL root %s", opts.Dir, opts.Generate.URLRoot)
+	}
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+	// Releases are generated from their own directory, never from the platform trees
+	opts.Generate.Platforms = nil
+	opts.Generate.Previous = nil
+	opts.Generate.Progress = nil
+	opts.Generate.SkipWrite = false
+	return &API{opts: opts}, nil
+}
+
+// Handler serves the API below /admin/
+func (a *API) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/releases", a.list)
+	mux.HandleFunc("PUT /admin/releases/{version}/files/{path...}", a.uploadFile)
+	mux.HandleFunc("POST /admin/releases/{version}/upload", a.uploadArchive)
+	mux.HandleFunc("POST /admin/releases/{version}/stage", a.stage)
+	mux.HandleFunc("POST /admin/releases/{version}/promote", a.promote)
+	mux.HandleFunc("DELETE /admin/releases/{version}", a.remove)
+	mux.HandleFunc("POST /admin/rollback", a.rollback)
+	return mux
+}
+
+func (a *API) releaseDir(version string) string {
+	return filepath.Join(a.opts.Dir, version)
+}
+
+func (a *API) filesDir(version string) string {
+	return filepath.Join(a.releaseDir(version), "files")
+}
+
+func (a *API) manifestFile(version string) string {
+	return filepath.Join(a.releaseDir(version), "manifest.json")
+}
+
+// list returns all releases and the live version
+func (a *API) list(w http.ResponseWriter, r *http.Request) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	st, err := a.loadState()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	entries, err := os.ReadDir(a.opts.Dir)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	releases := []Release{}
+	for _, entry := range entries {
+		if entry.IsDir() && versionPattern.MatchString(entry.Name()) {
+			releases = append(releases, a.release(entry.Name(), st))
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"live": st.Live, "releases": releases})
+}
+
+// release describes version, st is the current state
+func (a *API) release(version string, st *state) Release {
+	release := Release{
+		Version:  version,
+		Status:   StatusUploaded,
+		Previous: slices.Contains(st.History, version),
+	}
+	data, err := os.ReadFile(a.manifestFile(version))
+	if err != nil {
+		return release
+	}
+	release.Status = StatusStaged
+	if st.Live == version {
+		release.Status = StatusLive
+	}
+	if m, err := manifest.ParseManifest(data, manifest.LoadOptions{}); err == nil {
+		release.Files = len(m.Files)
+	}
+	if rel, err := filepath.Rel(a.opts.Generate.URLRoot, a.manifestFile(version)); err == nil {
+		release.ManifestURL = a.opts.Generate.BaseURL + filepath.ToSlash(rel)
+	}
+	return release
+}
+
+// version returns the release addressed by the request, answering invalid names with 400
+func (a *API) version(w http.ResponseWriter, r *http.Request) (string, bool) {
+	version := r.PathValue("version")
+	if !versionPattern.MatchString(version) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid version %q, use letters, digits and . _ + -", version))
+		return "", false
+	}
+	return version, true
+}
+
+// mutable checks that the files of a release may change: releases that are or were live are
+// kept as they are, clients may still be downloading them and rollbacks rely on them
+func (a *API) mutable(version string) error {
+	st, err := a.loadState()
+	if err != nil {
+		return err
+	}
+	if st.Live == version || slices.Contains(st.History, version) {
+		return fmt.Errorf("release %s has been live and cannot be changed, upload a new version", version)
+	}
+	return nil
+}
+
+// beginUpload prepares an upload to version, a staged manifest no longer matches the files afterwards
+func (a *API) beginUpload(w http.ResponseWriter, r *http.Request) (string, bool) {
+	version, ok := a.version(w, r)
+	if !ok {
+		return "", false
+	}
+	if err := a.mutable(version); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return "", false
+	}
+	if err := removeManifest(a.manifestFile(version)); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return "", false
+	}
+	if a.opts.MaxUpload > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, a.opts.MaxUpload)
+	}
+	return version, true
+}
+
+// uploadFile stores the request body as one file of a release, ?mode=0755 sets its permissions
+func (a *API) uploadFile(w http.ResponseWriter, r *http.Request) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	version, ok := a.beginUpload(w, r)
+	if !ok {
+		return
+	}
+	name := r.PathValue("path")
+	target, err := uploadPath(a.filesDir(version), name)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	mode := os.FileMode(0644)
+	if value := r.URL.Query().Get("mode"); value != "" {
+		parsed, err := strconv.ParseUint(value, 8, 32)
+		if err != nil || parsed > 0777 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid mode %q, expected octal permissions such as 0755", value))
+			return
+		}
+		mode = os.FileMode(parsed)
+	}
+
+	if err := writeFile(target, r.Body, mode, time.Now()); err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]any{"version": version, "path": name})
+}
+
+// uploadArchive extracts a tar archive, optionally gzip compressed, into a release
+func (a *API) uploadArchive(w http.ResponseWriter, r *http.Request) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	version, ok := a.beginUpload(w, r)
+	if !ok {
+		return
+	}
+	files, err := extract(r.Body, a.filesDir(version))
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]any{"version": version, "files": files})
+}
+
+// stageRequest is the optional body of a stage request
+type stageRequest struct {
+	// Changelog replaces the release notes configured on the server
+	Changelog *string `json:"changelog"`
+}
+
+// stage generates and signs the manifest of a release. The response lists the changes compared
+// to the live manifest, and files that could not be read fail with 422 Unprocessable Entity.
+func (a *API) stage(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	version, ok := a.version(w, r)
+	if !ok {
+		return
+	}
+	if err := a.mutable(version); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	if _, err := os.Stat(a.filesDir(version)); err != nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("release %s has no uploaded files", version))
+		return
+	}
+
+	var request stageRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %v", err))
+		return
+	}
+
+	opts := a.opts.Generate
+	opts.FilesDir = a.filesDir(version)
+	opts.OutputFile = a.manifestFile(version)
+	opts.Version = version
+	if request.Changelog != nil {
+		opts.Changelog = strings.TrimSpace(*request.Changelog)
+	}
+	result, err := manifest.GenerateManifest(opts)
+	var generateErr *manifest.GenerateError
+	if errors.As(err, &generateErr) {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]any{"error": err.Error(), "problems": generateErr.Problems})
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	response := map[string]any{
+		"release": a.release(version, &state{}),
+		"hashed":  result.Hashed,
+		"skipped": result.Skipped,
+	}
+	if live, err := os.ReadFile(a.opts.LiveFile); err == nil {
+		if current, err := manifest.ParseManifest(live, manifest.LoadOptions{}); err == nil {
+			response["changes"] = manifest.DiffManifests(current, result.Manifest)
+		}
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// promote makes a staged release live, the current live release becomes the rollback target
+func (a *API) promote(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	version, ok := a.version(w, r)
+	if !ok {
+		return
+	}
+	st, err := a.loadState()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if st.Live == version {
+		writeError(w, http.StatusConflict, fmt.Errorf("release %s is already live", version))
+		return
+	}
+	if err := a.makeLive(version); err != nil {
+		writeLiveError(w, version, err)
+		return
+	}
+
+	previous := st.Live
+	if previous != "" {
+		st.History = append(slices.DeleteFunc(st.History, func(v string) bool { return v == previous }), previous)
+	}
+	st.History = slices.DeleteFunc(st.History, func(v string) bool { return v == version })
+	st.Live = version
+	if err := a.saveState(st); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"live": version, "previous": previous})
+}
+
+// rollback makes the release that was live before the current one live again
+func (a *API) rollback(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	st, err := a.loadState()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(st.History) == 0 {
+		writeError(w, http.StatusConflict, errors.New("there is no previous release to roll back to"))
+		return
+	}
+
+	target := st.History[len(st.History)-1]
+	if err := a.makeLive(target); err != nil {
+		writeLiveError(w, target, err)
+		return
+	}
+	// The release rolled back from is not a rollback target itself
+	rolledBack := st.Live
+	st.Live = target
+	st.History = st.History[:len(st.History)-1]
+	if err := a.saveState(st); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"live": target, "rolled_back": rolledBack})
+}
+
+// remove deletes a release that is not live, it is no longer a rollback target afterwards
+func (a *API) remove(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	version, ok := a.version(w, r)
+	if !ok {
+		return
+	}
+	st, err := a.loadState()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if st.Live == version {
+		writeError(w, http.StatusConflict, fmt.Errorf("release %s is live, promote another release first", version))
+		return
+	}
+	if _, err := os.Stat(a.releaseDir(version)); err != nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("release %s does not exist", version))
+		return
+	}
+	if err := os.RemoveAll(a.releaseDir(version)); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	st.History = slices.DeleteFunc(st.History, func(v string) bool { return v == version })
+	if err := a.saveState(st); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// errNotStaged is returned by makeLive for releases without a manifest
+var errNotStaged = errors.New("release is not staged")
+
+// makeLive writes the staged manifest of version to the live manifest and publishes it
+func (a *API) makeLive(version string) error {
+	data, err := os.ReadFile(a.manifestFile(version))
+	if os.IsNotExist(err) {
+		return errNotStaged
+	} else if err != nil {
+		return err
+	}
+	m, err := manifest.ParseManifest(data, manifest.LoadOptions{})
+	if err != nil {
+		return err
+	}
+	data, signature, err := manifest.WriteManifest(m, a.opts.LiveFile, a.opts.Generate.SigningKey)
+	if err != nil {
+		return err
+	}
+	a.opts.Publish(m, data, signature)
+	return nil
+}
+
+func (a *API) loadState() (*state, error) {
+	data, err := os.ReadFile(filepath.Join(a.opts.Dir, stateFile))
+	if os.IsNotExist(err) {
+		return &state{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var st state
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", stateFile, err)
+	}
+	return &st, nil
+}
+
+func (a *API) saveState(st *state) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(a.opts.Dir, stateFile), strings.NewReader(string(data)), 0644, time.Now())
+}
+
+// removeManifest removes a staged manifest and its signature
+func removeManifest(manifestFile string) error {
+	for _, file := range []string{manifestFile, manifestFile + manifest.SignatureSuffix} {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// writeUploadError answers failed uploads, bodies over the size limit with 413 Request Entity Too Large
+func writeUploadError(w http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	var pathErr *uploadError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("upload is larger than %d bytes", maxBytesErr.Limit))
+	case errors.As(err, &pathErr):
+		writeError(w, http.StatusBadRequest, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// writeLiveError answers a failed promotion or rollback
+func writeLiveError(w http.ResponseWriter, version string, err error) {
+	if errors.Is(err, errNotStaged) {
+		writeError(w, http.StatusConflict, fmt.Errorf("release %s is not staged, stage it first", version))
+		return
+	}
+	writeError(w, http.StatusInternalServerError, fmt.Errorf("error making release %s live: %v", version, err))
+}
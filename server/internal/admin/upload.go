@@ -0,0 +1,140 @@
+package admin
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sogladev/go-manifest-patcher/pkg/manifest"
+)
+
+// uploadError is an upload rejected because of its content, such as an unsafe path
+type uploadError struct {
+	name string
+	err  error
+}
+
+func (e *uploadError) Error() string {
+	return fmt.Sprintf("%s: %v", e.name, e.err)
+}
+
+// uploadPath resolves the path of an uploaded file below dir. Paths must be valid manifest paths
+// and hidden files are refused, the server would not serve them.
+func uploadPath(dir, name string) (string, error) {
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") && segment != ".." {
+			return "", &uploadError{name: name, err: errors.New("hidden files and directories are not served")}
+		}
+	}
+	target, err := manifest.ResolvePath(dir, name)
+	if err != nil {
+		return "", &uploadError{name: name, err: err}
+	}
+	return target, nil
+}
+
+// writeFile atomically replaces target with the content of r
+func writeFile(target string, r io.Reader, mode os.FileMode, modTime time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(target), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	_, err = io.Copy(temp, r)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(temp.Name(), mode); err != nil {
+		return err
+	}
+	if err := os.Chtimes(temp.Name(), modTime, modTime); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), target)
+}
+
+// extract unpacks a tar archive, gzip compressed or not, into dir and returns the number of files.
+// Permissions and modification times are kept. Symlinks must stay inside the archive, other special
+// files are refused.
+func extract(r io.Reader, dir string) (int, error) {
+	buffered := bufio.NewReader(r)
+	var archive io.Reader = buffered
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		decompressed, err := gzip.NewReader(buffered)
+		if err != nil {
+			return 0, err
+		}
+		archive = decompressed
+	}
+
+	files := 0
+	reader := tar.NewReader(archive)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return files, &uploadError{name: "archive", err: err}
+		}
+
+		// Archives often start their paths with "./"
+		name := strings.TrimSuffix(strings.TrimPrefix(header.Name, "./"), "/")
+		if name == "" || name == "." {
+			continue
+		}
+		target, err := uploadPath(dir, name)
+		if err != nil {
+			return files, err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return files, err
+			}
+		case tar.TypeReg:
+			if err := writeFile(target, reader, header.FileInfo().Mode().Perm(), header.ModTime); err != nil {
+				return files, err
+			}
+			files++
+		case tar.TypeSymlink:
+			linked := path.Join(path.Dir(name), header.Linkname)
+			if path.IsAbs(header.Linkname) || linked == ".." || strings.HasPrefix(linked, "../") {
+				return files, &uploadError{name: name, err: fmt.Errorf("symlink target %s is outside of the release", header.Linkname)}
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return files, err
+			}
+			if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+				return files, err
+			}
+			// Symlinks extracted earlier may lead elsewhere than the names suggest
+			if _, err := manifest.ResolveSymlinkTarget(dir, target, header.Linkname); err != nil {
+				return files, &uploadError{name: name, err: err}
+			}
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return files, err
+			}
+			files++
+		case tar.TypeXGlobalHeader:
+		default:
+			return files, &uploadError{name: name, err: fmt.Errorf("unsupported archive entry type %q", header.Typeflag)}
+		}
+	}
+	return files, nil
+}
@@ -2,32 +2,302 @@ package config
 
 import (
 	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/sogladev/go-manifest-patcher/pkg/manifest"
 )
 
+// Channel is a release channel generated from its own directory, e.g. "beta@2.0-beta1=build/beta"
+type Channel struct {
+	Name    string
+	Version string // defaults to -version
+	Dir     string
+}
+
 type Config struct {
+	Addr           string
+	Root           string
+	ServePaths     []string
+	AccessLog      string
+	TLSCert        string
+	TLSKey         string
+	TLSSelfSigned  bool
+	TLSHosts       []string
+	Metrics        bool
+	Stats          bool
+	MetricsAddr    string
+	AuthTokens     string
+	URLKey         string
+	SignURL        string
+	URLPrefixes    []string
+	URLExpiry      time.Duration
+	AdminTokens    string
+	ReleasesDir    string
+	MaxUpload      int64
+	FaultsFile     string
+	RateLimit      int64
+	ClientRate     int64
+	MaxPerClient   int
+	QueueTimeout   time.Duration
 	Interval       int
 	CreateManifest bool
 	FilesDir       string
 	BaseURL        string
 	Version        string
+	CustomPatterns []string
+	Platforms      []manifest.PlatformTree
+	Channels       []Channel
+	HooksFile      string
+	SignKey        string
+	GenerateKeys   bool
+	ChangelogFile  string
+	Incremental    bool
+	Watch          bool
+	WatchInterval  time.Duration
+	Debounce       time.Duration
+	VersionPolicy  string
+	Workers        int
+	PathPrefix     string
+	URLRoot        string
+	OutputFile     string
+	Include        []string
+	Exclude        []string
+	Lenient        bool
+	Progress       string
+	ObjectsDir     string
+	Compress       bool
 }
 
 func InitConfig() *Config {
-	// Add command-line flag for throttle interval
-	interval := flag.Int("interval", 1, "ms delay per chunk")
+	addr := flag.String("addr", ":8080", "Address to listen on")
+	root := flag.String("root", ".", "Directory with the published content, only the manifests, the files directory, -objects and -releases below it are served")
+	servePaths := flag.String("serve-paths", "", "Comma-separated files and directories below -root served in addition to the published content (e.g. \"manifest.pub,launcher\")")
+	accessLog := flag.String("access-log", "-", "File to append the access log to, \"-\" for stderr and \"\" to disable")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate file, serves HTTPS together with -tls-key")
+	tlsKey := flag.String("tls-key", "", "PEM private key file of -tls-cert")
+	tlsSelfSigned := flag.Bool("tls-self-signed", false, "Serve HTTPS with a self-signed certificate for testing, generated at -tls-cert/-tls-key (default tls.crt, tls.key) when missing")
+	tlsHosts := flag.String("tls-hosts", "localhost,127.0.0.1,::1", "Comma-separated host names and IP addresses of the generated self-signed certificate")
+	rateLimit := flag.String("rate-limit", "", "Total bandwidth in bytes per second, e.g. \"100MB\" (default: unlimited)")
+	clientRate := flag.String("client-rate-limit", "", "Bandwidth per client IP in bytes per second, e.g. \"2MB\" (default: unlimited)")
+	maxPerClient := flag.Int("max-per-client", 0, "Concurrent downloads per client IP, 0 for unlimited")
+	queueTimeout := flag.Duration("queue-timeout", 0, "How long requests over -max-per-client wait for a free slot before a 429 response, 0 responds immediately")
+	metricsEnabled := flag.Bool("metrics", false, "Serve Prometheus metrics on /metrics")
+	stats := flag.Bool("stats", false, "Serve download and release adoption statistics as JSON on /stats")
+	metricsAddr := flag.String("metrics-addr", "", "Serve /metrics and /stats on this address instead of -addr, e.g. \"127.0.0.1:9090\"")
+	authTokens := flag.String("auth-tokens", "", "File with access tokens, one per line, required as \"Authorization: Bearer <token>\" for manifests and files")
+	urlKey := flag.String("url-key", "", "Secret file for signed URLs, which grant access to manifests and files without a token until they expire")
+	signURL := flag.String("sign-url", "", "Print a signed URL for this URL using -url-key and exit, e.g. \"https://patch.example.com/manifest.json\"")
+	urlPrefix := flag.String("url-prefix", "/", "Comma-separated directories ending with / whose paths are accessible with the URL signed by -sign-url, or single paths")
+	urlExpiry := flag.Duration("url-expiry", 7*24*time.Hour, "How long the URL signed by -sign-url stays valid")
+	adminTokens := flag.String("admin-tokens", "", "File with admin tokens, one per line, enables the admin API on /admin/ to upload, stage, promote and roll back releases")
+	releasesDir := flag.String("releases", "releases", "Directory of the releases uploaded through the admin API, must be inside -url-root")
+	maxUpload := flag.String("max-upload", "10GB", "Largest request body accepted by the admin API, e.g. \"2GB\"")
+	faultsFile := flag.String("faults", "", "JSON file with faults to inject into matching requests (resets, wrong lengths, corrupt bytes, error responses, stalls, latency)")
+	// Throttling simulates slow connections for testing
+	interval := flag.Int("interval", 0, "ms delay per 1KB chunk to simulate a slow connection, 0 disables throttling")
 	// Generate a manifest file for the input directory
 	createManifest := flag.Bool("create-manifest", false, "Generate manifest.json before starting the server")
 	filesDir := flag.String("files", "files", "Directory containing the files to process")
 	baseURL := flag.String("url", "http://localhost:8080/", "Base URL for file download links")
 	version := flag.String("version", "1.0", "Manifest version")
+	custom := flag.String("custom", "", "Comma-separated glob patterns of user-customizable files that are never overwritten once installed (e.g. \"files/*.cfg\")")
+	platforms := flag.String("platforms", "", "Comma-separated platform specific trees merged into the manifest (e.g. \"linux/amd64=files-linux,windows/amd64=files-windows\")")
+	channels := flag.String("channels", "", "Comma-separated release channels, each generated from its own directory into channels/<name>/manifest.json (e.g. \"stable=build/stable,beta@2.0-beta1=build/beta\"), the first one is the default")
+	hooksFile := flag.String("hooks", "", "JSON file with post-install hooks to include in the manifest")
+	signKey := flag.String("sign-key", "", "Private key file used to sign the generated manifest")
+	changelogFile := flag.String("changelog", "", "Text file with release notes to include in the manifest")
+	pathPrefix := flag.String("path-prefix", "", "Prefix added to manifest paths, which are relative to the files directory (default: the files directory, e.g. \"files/\")")
+	urlRoot := flag.String("url-root", ".", "Directory served at the base URL, file URLs are the base URL plus the path below it")
+	outputFile := flag.String("output", "manifest.json", "Path of the generated manifest")
+	include := flag.String("include", "", "Comma-separated glob patterns of files to include in the manifest (default: all files)")
+	exclude := flag.String("exclude", "", "Comma-separated glob patterns of files to leave out of the manifest")
+	incremental := flag.Bool("incremental", false, "Reuse hashes from the existing manifest.json for files with unchanged size and modification time")
+	watchFiles := flag.Bool("watch", false, "Regenerate and serve the manifest whenever the files change")
+	watchInterval := flag.Duration("watch-interval", 2*time.Second, "How often the files are checked for changes with -watch")
+	debounce := flag.Duration("debounce", 5*time.Second, "How long the files must stay unchanged before the manifest is regenerated with -watch")
+	versionPolicy := flag.String("version-policy", "patch", "How -watch bumps the version of a new manifest: patch, minor, major, timestamp or none")
+	workers := flag.Int("workers", 0, "Number of files hashed concurrently (default: number of CPUs)")
+	objectsDir := flag.String("objects", "", "Publish files into this content-addressed store (e.g. \"objects\") and point manifest URLs at it, must be inside -url-root")
+	compress := flag.Bool("compress", false, "Write a gzip copy (.gz) next to every published file that shrinks by compression, served to clients accepting gzip")
+	lenient := flag.Bool("lenient", false, "Skip files that cannot be read instead of failing, skipped files are listed at the end")
+	progress := flag.String("progress", "none", "Progress output while generating: none, text or json (one JSON object per line)")
+	generateKeys := flag.Bool("generate-keys", false, "Generate a signing key pair (manifest.key, manifest.pub) and exit")
 
 	flag.Parse()
 
+	var channelList []Channel
+	for _, value := range splitList(*channels) {
+		channel, err := parseChannel(value)
+		if err != nil {
+			log.Fatal(err)
+		}
+		channelList = append(channelList, channel)
+	}
+	if len(channelList) > 0 && *platforms != "" {
+		log.Fatal("-channels cannot be combined with -platforms")
+	}
+
+	// Keep the paths of earlier versions, which were relative to the working directory.
+	// Channels install into the same place, so their paths have no prefix by default.
+	pathPrefixSet := false
+	flag.Visit(func(f *flag.Flag) {
+		pathPrefixSet = pathPrefixSet || f.Name == "path-prefix"
+	})
+	if !pathPrefixSet && len(channelList) == 0 {
+		*pathPrefix = filepath.ToSlash(filepath.Clean(*filesDir)) + "/"
+	}
+
+	switch *versionPolicy {
+	case "patch", "minor", "major", "timestamp", "none":
+	default:
+		log.Fatalf("invalid -version-policy %q, expected patch, minor, major, timestamp or none", *versionPolicy)
+	}
+	if *watchInterval <= 0 {
+		log.Fatal("-watch-interval must be positive")
+	}
+
+	switch *progress {
+	case "none", "text", "json":
+	default:
+		log.Fatalf("invalid -progress %q, expected none, text or json", *progress)
+	}
+
+	if *tlsSelfSigned {
+		if *tlsCert == "" {
+			*tlsCert = "tls.crt"
+		}
+		if *tlsKey == "" {
+			*tlsKey = "tls.key"
+		}
+	}
+	if *adminTokens != "" && (*watchFiles || len(channelList) > 0) {
+		log.Fatal("-admin-tokens cannot be combined with -watch or -channels")
+	}
+	maxUploadBytes, err := humanize.ParseBytes(*maxUpload)
+	if err != nil {
+		log.Fatalf("invalid -max-upload: %v", err)
+	}
+	if *signURL != "" && *urlKey == "" {
+		log.Fatal("-sign-url requires -url-key")
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatal("-tls-cert and -tls-key must be used together")
+	}
+
+	rateLimitBytes, err := parseRate(*rateLimit)
+	if err != nil {
+		log.Fatalf("invalid -rate-limit: %v", err)
+	}
+	clientRateBytes, err := parseRate(*clientRate)
+	if err != nil {
+		log.Fatalf("invalid -client-rate-limit: %v", err)
+	}
+
+	var platformTrees []manifest.PlatformTree
+	for _, value := range splitList(*platforms) {
+		tree, err := manifest.ParsePlatformTree(value)
+		if err != nil {
+			log.Fatal(err)
+		}
+		platformTrees = append(platformTrees, tree)
+	}
+
 	return &Config{
+		Addr:           *addr,
+		Root:           *root,
+		ServePaths:     splitList(*servePaths),
+		AccessLog:      *accessLog,
+		TLSCert:        *tlsCert,
+		TLSKey:         *tlsKey,
+		TLSSelfSigned:  *tlsSelfSigned,
+		TLSHosts:       splitList(*tlsHosts),
+		Metrics:        *metricsEnabled,
+		Stats:          *stats,
+		MetricsAddr:    *metricsAddr,
+		AuthTokens:     *authTokens,
+		URLKey:         *urlKey,
+		SignURL:        *signURL,
+		URLPrefixes:    splitList(*urlPrefix),
+		URLExpiry:      *urlExpiry,
+		AdminTokens:    *adminTokens,
+		ReleasesDir:    *releasesDir,
+		MaxUpload:      int64(maxUploadBytes),
+		FaultsFile:     *faultsFile,
+		RateLimit:      rateLimitBytes,
+		ClientRate:     clientRateBytes,
+		MaxPerClient:   *maxPerClient,
+		QueueTimeout:   *queueTimeout,
 		Interval:       *interval,
 		CreateManifest: *createManifest,
 		FilesDir:       *filesDir,
 		BaseURL:        *baseURL,
 		Version:        *version,
+		CustomPatterns: splitList(*custom),
+		Platforms:      platformTrees,
+		Channels:       channelList,
+		HooksFile:      *hooksFile,
+		SignKey:        *signKey,
+		GenerateKeys:   *generateKeys,
+		ChangelogFile:  *changelogFile,
+		Incremental:    *incremental,
+		Watch:          *watchFiles,
+		WatchInterval:  *watchInterval,
+		Debounce:       *debounce,
+		VersionPolicy:  *versionPolicy,
+		Workers:        *workers,
+		PathPrefix:     *pathPrefix,
+		URLRoot:        *urlRoot,
+		OutputFile:     *outputFile,
+		Include:        splitList(*include),
+		Exclude:        splitList(*exclude),
+		Lenient:        *lenient,
+		Progress:       *progress,
+		ObjectsDir:     *objectsDir,
+		Compress:       *compress,
+	}
+}
+
+// parseRate parses a bandwidth such as "2MB" or "512KiB" per second, empty means unlimited
+func parseRate(value string) (int64, error) {
+	if strings.TrimSpace(value) == "" {
+		return 0, nil
+	}
+	rate, err := humanize.ParseBytes(strings.TrimSuffix(value, "/s"))
+	if err != nil {
+		return 0, err
+	}
+	return int64(rate), nil
+}
+
+// parseChannel parses "name=dir" or "name@version=dir"
+func parseChannel(value string) (Channel, error) {
+	spec, dir, ok := strings.Cut(value, "=")
+	if !ok || dir == "" {
+		return Channel{}, fmt.Errorf("invalid channel %q, expected name=dir or name@version=dir", value)
+	}
+	name, version, _ := strings.Cut(spec, "@")
+	if err := manifest.ValidatePath(name); err != nil || strings.Contains(name, "/") {
+		return Channel{}, fmt.Errorf("invalid channel name %q", name)
+	}
+	return Channel{Name: name, Version: version, Dir: dir}, nil
+}
+
+// splitList splits a comma-separated flag value, an empty value returns nil
+func splitList(value string) []string {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
+	return items
 }
@@ -0,0 +1,67 @@
+package diff
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/sogladev/go-manifest-patcher/pkg/manifest"
+)
+
+// Run implements the "diff" command: diff [-json] [-exit-code] old.json new.json
+func Run(args []string) int {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	jsonOutput := flags.Bool("json", false, "Print the diff as JSON")
+	exitCode := flags.Bool("exit-code", false, "Exit with status 1 when the manifests differ")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: diff [-json] [-exit-code] old.json new.json")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+
+	oldManifest, err := load(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 2
+	}
+	newManifest, err := load(flags.Arg(1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 2
+	}
+
+	d := manifest.DiffManifests(oldManifest, newManifest)
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(d); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return 2
+		}
+	} else {
+		d.Print(os.Stdout)
+	}
+
+	if *exitCode && d.HasChanges() {
+		return 1
+	}
+	return 0
+}
+
+func load(path string) (*manifest.Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m, err := manifest.ParseManifest(data, manifest.LoadOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return m, nil
+}
@@ -0,0 +1,198 @@
+package serve
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query parameters of signed URLs
+const (
+	ExpiresParam   = "expires"   // Unix time after which the URL is rejected
+	PrefixParam    = "prefix"    // a directory ending with "/", e.g. "/channels/beta/", or a single path, may be repeated
+	SignatureParam = "signature" // HMAC-SHA256 of the prefixes and expiry, hex encoded
+)
+
+// Auth restricts manifests and files to clients presenting a token or a signed URL
+type Auth struct {
+	// Tokens are accepted in an "Authorization: Bearer <token>" header
+	Tokens []string
+	// URLKey is the secret of signed URLs, nil disables signed URLs
+	URLKey []byte
+}
+
+// LoadTokens reads one token per line, empty lines and lines starting with # are ignored
+func LoadTokens(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var tokens []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens = append(tokens, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no tokens found in %s", path)
+	}
+	return tokens, nil
+}
+
+// LoadURLKey reads the secret of signed URLs, any file of at least 16 bytes works,
+// e.g. one created with "head -c 32 /dev/urandom > url.key"
+func LoadURLKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) < 16 {
+		return nil, fmt.Errorf("URL signing key %s is too short, use at least 16 random bytes", path)
+	}
+	return key, nil
+}
+
+// SignURL adds an expiring signature to rawURL, granting access to every path below one of the prefixes,
+// or to the path itself for a prefix not ending with "/". Several prefixes let a link to a channel
+// manifest cover the files of the channel as well, e.g. "/channels/beta/" and "/build/beta/".
+func SignURL(rawURL string, prefixes []string, expires time.Time, key []byte) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if len(prefixes) == 0 {
+		return "", errors.New("no prefix to sign")
+	}
+	for _, prefix := range prefixes {
+		if !strings.HasPrefix(prefix, "/") || strings.Contains(prefix, "\n") {
+			return "", fmt.Errorf("prefix %q must start with /", prefix)
+		}
+	}
+	if !covers(prefixes, u.Path) {
+		for _, prefix := range prefixes {
+			if !strings.HasSuffix(prefix, "/") && strings.HasPrefix(u.Path, prefix) {
+				return "", fmt.Errorf("prefix %s must end with / to cover %s", prefix, u.Path)
+			}
+		}
+		return "", fmt.Errorf("prefixes %s do not cover %s", strings.Join(prefixes, ", "), u.Path)
+	}
+
+	query := u.Query()
+	query.Set(ExpiresParam, strconv.FormatInt(expires.Unix(), 10))
+	query[PrefixParam] = prefixes
+	query.Set(SignatureParam, urlSignature(prefixes, expires.Unix(), key))
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// covers reports whether one of the signed prefixes grants access to urlPath. Prefixes are compared by
+// whole path segments, "/channels/beta/" does not cover "/channels/beta-internal/".
+func covers(prefixes []string, urlPath string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasSuffix(prefix, "/") && strings.HasPrefix(urlPath, prefix) || urlPath == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// urlSignature signs the prefixes in order and the expiry, one per line
+func urlSignature(prefixes []string, expires int64, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%d", strings.Join(prefixes, "\n"), expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Protect answers requests without credentials or with an unknown token with 401 Unauthorized,
+// and requests with a signed URL that is invalid, expired or does not cover the path with 403 Forbidden
+func (a *Auth) Protect(next http.Handler) http.Handler {
+	// Comparing hashes keeps the comparison constant time regardless of the token lengths
+	tokens := make([][sha256.Size]byte, len(a.Tokens))
+	for i, token := range a.Tokens {
+		tokens[i] = sha256.Sum256([]byte(token))
+	}
+	validToken := func(token string) bool {
+		sum := sha256.Sum256([]byte(token))
+		valid := 0
+		for _, known := range tokens {
+			valid |= subtle.ConstantTimeCompare(sum[:], known[:])
+		}
+		return valid == 1
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if header := r.Header.Get("Authorization"); header != "" {
+			scheme, token, _ := strings.Cut(header, " ")
+			if strings.EqualFold(scheme, "Bearer") && validToken(strings.TrimSpace(token)) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="patcher", error="invalid_token"`)
+			http.Error(w, "Invalid access token", http.StatusUnauthorized)
+			return
+		}
+
+		if query := r.URL.Query(); query.Has(SignatureParam) {
+			if err := a.verifyURL(r.URL.Path, query); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("WWW-Authenticate", `Bearer realm="patcher"`)
+		http.Error(w, "Access token required", http.StatusUnauthorized)
+	})
+}
+
+// verifyURL checks the signature of a signed URL for urlPath
+func (a *Auth) verifyURL(urlPath string, query url.Values) error {
+	if a.URLKey == nil {
+		return errors.New("signed URLs are not accepted")
+	}
+	prefixes := query[PrefixParam]
+	expires, err := strconv.ParseInt(query.Get(ExpiresParam), 10, 64)
+	if err != nil {
+		return errors.New("invalid signed URL")
+	}
+	if !hmac.Equal([]byte(query.Get(SignatureParam)), []byte(urlSignature(prefixes, expires, a.URLKey))) {
+		return errors.New("invalid signed URL")
+	}
+	if time.Now().Unix() > expires {
+		return fmt.Errorf("signed URL expired at %s", time.Unix(expires, 0).UTC().Format(time.RFC3339))
+	}
+	if len(prefixes) == 0 || !covers(prefixes, path.Clean("/"+urlPath)) {
+		return errors.New("signed URL does not cover this path")
+	}
+	return nil
+}
+
+// redactedURI returns the request URI with the signature of signed URLs removed, for logging
+func redactedURI(r *http.Request) string {
+	query := r.URL.Query()
+	if !query.Has(SignatureParam) {
+		return r.URL.RequestURI()
+	}
+	query.Set(SignatureParam, "REDACTED")
+	return r.URL.EscapedPath() + "?" + query.Encode()
+}
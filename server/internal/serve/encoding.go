@@ -0,0 +1,61 @@
+package serve
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sogladev/go-manifest-patcher/pkg/manifest"
+)
+
+// precompressed opens the pre-compressed copy of name that the client accepts, preferring the
+// order of manifest.CompressedCopies. Only copies with the modification time of the file are used,
+// others were not updated along with it or are content of their own. vary reports whether name has
+// copies at all, responses then depend on the Accept-Encoding header.
+func (s *Server) precompressed(r *http.Request, name string, info os.FileInfo) (file *os.File, copyInfo os.FileInfo, encoding string, vary bool) {
+	accept := r.Header.Get("Accept-Encoding")
+	for _, c := range manifest.CompressedCopies {
+		// Resolved on their own, a copy may be a symlink leading outside of the root
+		copyPath, err := manifest.ResolvePath(s.opts.Root, name+c.Suffix)
+		if err != nil {
+			continue
+		}
+		candidateInfo, err := os.Stat(copyPath)
+		if err != nil || !candidateInfo.Mode().IsRegular() {
+			continue
+		}
+		vary = true
+		if file != nil || !acceptsEncoding(accept, c.Encoding) || !candidateInfo.ModTime().Equal(info.ModTime()) {
+			continue
+		}
+		if candidate, err := os.Open(copyPath); err == nil {
+			file, copyInfo, encoding = candidate, candidateInfo, c.Encoding
+		}
+	}
+	return file, copyInfo, encoding, vary
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows coding, honoring q=0 and "*"
+func acceptsEncoding(header, coding string) bool {
+	wildcard := false
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(key, "q") {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		switch name = strings.TrimSpace(name); {
+		case strings.EqualFold(name, coding):
+			return q > 0
+		case name == "*":
+			wildcard = q > 0
+		}
+	}
+	return wildcard
+}
@@ -0,0 +1,223 @@
+package serve
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gobwas/glob"
+)
+
+// Fault types
+const (
+	FaultReset   = "reset"   // close the connection after After bytes of the body
+	FaultLength  = "length"  // announce a Content-Length that is Extra bytes off (default 1 too long)
+	FaultCorrupt = "corrupt" // flip the byte at offset After of the body
+	FaultStatus  = "status"  // respond with Status (default 503) and a Retry-After of RetryAfter seconds
+	FaultStall   = "stall"   // stop sending after After bytes for Delay ms, or until the client gives up
+	FaultLatency = "latency" // wait Delay ms plus up to Jitter ms before responding
+)
+
+// Fault injects an error into responses for matching paths, to test the downloader locally
+type Fault struct {
+	Path        string  `json:"Path"` // glob pattern matched against the request path without leading slash, e.g. "files/*.bin"
+	Type        string  `json:"Type"`
+	Probability float64 `json:"Probability,omitempty"` // chance per request from 0 to 1, always when unset
+	After       int64   `json:"After,omitempty"`       // bytes of the body sent before the fault
+	Extra       int64   `json:"Extra,omitempty"`
+	Status      int     `json:"Status,omitempty"`
+	RetryAfter  int     `json:"RetryAfter,omitempty"`
+	Delay       int     `json:"Delay,omitempty"`
+	Jitter      int     `json:"Jitter,omitempty"`
+
+	pattern glob.Glob
+}
+
+// LoadFaults reads a JSON list of faults
+func LoadFaults(path string) ([]Fault, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var faults []Fault
+	if err := json.Unmarshal(data, &faults); err != nil {
+		return nil, fmt.Errorf("error parsing faults %s: %v", path, err)
+	}
+	for i := range faults {
+		fault := &faults[i]
+		switch fault.Type {
+		case FaultReset, FaultLength, FaultCorrupt, FaultStatus, FaultStall, FaultLatency:
+		default:
+			return nil, fmt.Errorf("fault %d: unknown type %q", i, fault.Type)
+		}
+		if fault.Probability < 0 || fault.Probability > 1 {
+			return nil, fmt.Errorf("fault %d: probability %v is not between 0 and 1", i, fault.Probability)
+		}
+		if fault.pattern, err = glob.Compile(fault.Path); err != nil {
+			return nil, fmt.Errorf("fault %d: invalid pattern %q: %v", i, fault.Path, err)
+		}
+	}
+	return faults, nil
+}
+
+// triggered rolls the dice for a request to name
+func (f *Fault) triggered(name string) bool {
+	if !f.pattern.Match(name) {
+		return false
+	}
+	return f.Probability == 0 || rand.Float64() < f.Probability
+}
+
+// injectFaults applies the matching faults to each request before it reaches next
+func injectFaults(faults []Fault, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		fw := &faultWriter{ResponseWriter: w, request: r}
+		for i := range faults {
+			fault := &faults[i]
+			if !fault.triggered(name) {
+				continue
+			}
+			log.Printf("Injecting %s fault for %s", fault.Type, r.URL.Path)
+
+			switch fault.Type {
+			case FaultLatency:
+				delay := time.Duration(fault.Delay) * time.Millisecond
+				if fault.Jitter > 0 {
+					delay += time.Duration(rand.Intn(fault.Jitter+1)) * time.Millisecond
+				}
+				select {
+				case <-time.After(delay):
+				case <-r.Context().Done():
+					return
+				}
+			case FaultStatus:
+				status := fault.Status
+				if status == 0 {
+					status = http.StatusServiceUnavailable
+				}
+				if fault.RetryAfter > 0 {
+					w.Header().Set("Retry-After", strconv.Itoa(fault.RetryAfter))
+				}
+				http.Error(w, http.StatusText(status), status)
+				return
+			default:
+				// Body faults happen while the response is written
+				fw.faults = append(fw.faults, fault)
+			}
+		}
+		if len(fw.faults) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(fw, r)
+	})
+}
+
+// faultWriter applies body faults to a response
+type faultWriter struct {
+	http.ResponseWriter
+	request *http.Request
+	faults  []*Fault
+	written int64
+	broken  bool
+}
+
+func (w *faultWriter) WriteHeader(status int) {
+	for _, fault := range w.faults {
+		if fault.Type != FaultLength {
+			continue
+		}
+		length, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64)
+		if err != nil {
+			continue
+		}
+		extra := fault.Extra
+		if extra == 0 {
+			extra = 1
+		}
+		// Too short a length truncates the body, too long a length leaves the client waiting for more
+		w.Header().Set("Content-Length", strconv.FormatInt(max(length+extra, 0), 10))
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *faultWriter) Write(p []byte) (int, error) {
+	if w.broken {
+		return 0, net.ErrClosed
+	}
+	start := w.written
+	end := start + int64(len(p))
+
+	for _, fault := range w.faults {
+		if fault.After < start || fault.After >= end {
+			continue
+		}
+		offset := fault.After - start
+		switch fault.Type {
+		case FaultCorrupt:
+			corrupted := append([]byte(nil), p...)
+			corrupted[offset] ^= 0xFF
+			p = corrupted
+		case FaultReset, FaultStall:
+			n, err := w.ResponseWriter.Write(p[:offset])
+			w.written += int64(n)
+			if err != nil {
+				return n, err
+			}
+			if fault.Type == FaultReset {
+				w.reset()
+				return n, net.ErrClosed
+			}
+			w.stall(fault)
+			return n, net.ErrClosed
+		}
+	}
+
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// reset sends what was written so far and drops the connection
+func (w *faultWriter) reset() {
+	w.broken = true
+	controller := http.NewResponseController(w.ResponseWriter)
+	controller.Flush()
+	conn, _, err := controller.Hijack()
+	if err != nil {
+		// HTTP/2 connections cannot be hijacked, aborting resets the stream instead
+		panic(http.ErrAbortHandler)
+	}
+	// Without lingering the close sends a TCP reset instead of a normal close
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// stall stops sending for the fault delay, or until the client gives up, then drops the connection
+func (w *faultWriter) stall(fault *Fault) {
+	http.NewResponseController(w.ResponseWriter).Flush()
+	var timeout <-chan time.Time
+	if fault.Delay > 0 {
+		timeout = time.After(time.Duration(fault.Delay) * time.Millisecond)
+	}
+	select {
+	case <-timeout:
+	case <-w.request.Context().Done():
+	}
+	w.reset()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *faultWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,246 @@
+package serve
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limits caps bandwidth and concurrent downloads, zero values mean unlimited
+type Limits struct {
+	// Rate is the total bandwidth of the server in bytes per second
+	Rate int64
+	// ClientRate is the bandwidth of a single client IP in bytes per second
+	ClientRate int64
+	// MaxPerClient is the number of concurrent requests of a single client IP
+	MaxPerClient int
+	// QueueTimeout is how long a request waits for a free slot before it is answered with 429,
+	// 0 answers immediately
+	QueueTimeout time.Duration
+}
+
+// maxChunk is the largest write that waits for tokens at once, smaller chunks keep the rate smooth
+const maxChunk = 32 * 1024
+
+// bucket is a token bucket holding up to one second of bandwidth
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate int64) *bucket {
+	return &bucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// wait takes n tokens, sleeping until they are available or ctx is done. Time spent waiting is added to m.
+func (b *bucket) wait(ctx context.Context, n int, m *metrics) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+	m.addDelay(delay)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// full reports whether the bucket has refilled completely at now
+func (b *bucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.rate
+}
+
+// client is the limiter state of one IP address
+type client struct {
+	slots  chan struct{}
+	bucket *bucket
+	active int
+}
+
+// idle reports whether c has no requests and a full bucket, dropping it then does not change its limits
+func (c *client) idle(now time.Time) bool {
+	return c.active == 0 && (c.bucket == nil || c.bucket.full(now))
+}
+
+// limiter enforces Limits
+type limiter struct {
+	limits  Limits
+	metrics *metrics
+	global  *bucket
+	mu      sync.Mutex
+	clients map[string]*client
+	pruned  time.Time
+}
+
+func newLimiter(limits Limits, m *metrics) *limiter {
+	l := &limiter{limits: limits, metrics: m, clients: map[string]*client{}}
+	if limits.Rate > 0 {
+		l.global = newBucket(limits.Rate)
+	}
+	return l
+}
+
+// acquire reserves a download slot for ip, it returns nil when no slot became free in time
+func (l *limiter) acquire(ctx context.Context, ip string) *client {
+	l.mu.Lock()
+	c := l.clients[ip]
+	if c == nil {
+		l.prune()
+		c = &client{}
+		if l.limits.MaxPerClient > 0 {
+			c.slots = make(chan struct{}, l.limits.MaxPerClient)
+		}
+		if l.limits.ClientRate > 0 {
+			c.bucket = newBucket(l.limits.ClientRate)
+		}
+		l.clients[ip] = c
+	}
+	c.active++
+	l.mu.Unlock()
+
+	if c.slots == nil {
+		return c
+	}
+	select {
+	case c.slots <- struct{}{}:
+		return c
+	default:
+	}
+	if l.limits.QueueTimeout > 0 {
+		start := time.Now()
+		defer func() { l.metrics.addDelay(time.Since(start)) }()
+		timer := time.NewTimer(l.limits.QueueTimeout)
+		defer timer.Stop()
+		select {
+		case c.slots <- struct{}{}:
+			return c
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+	}
+	l.forget(ip, c)
+	return nil
+}
+
+// release frees the slot taken by acquire
+func (l *limiter) release(ip string, c *client) {
+	if c.slots != nil {
+		<-c.slots
+	}
+	l.forget(ip, c)
+}
+
+// forget drops the state of a client without requests once its bucket is full again, a client
+// downloading files one after another keeps its bucket and does not get a new burst with every file
+func (l *limiter) forget(ip string, c *client) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c.active--
+	if c.idle(time.Now()) {
+		delete(l.clients, ip)
+	}
+}
+
+// prune drops idle clients kept by forget, so the map does not grow with every address seen.
+// It runs at most once per second and must be called with l.mu held.
+func (l *limiter) prune() {
+	now := time.Now()
+	if now.Sub(l.pruned) < time.Second {
+		return
+	}
+	l.pruned = now
+	for ip, c := range l.clients {
+		if c.idle(now) {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+// limit applies the limits to every request
+func limit(limits Limits, m *metrics, next http.Handler) http.Handler {
+	l := newLimiter(limits, m)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+
+		c := l.acquire(r.Context(), ip)
+		if c == nil {
+			retryAfter := max(int(limits.QueueTimeout.Seconds()), 1)
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			http.Error(w, "Too many concurrent downloads", http.StatusTooManyRequests)
+			return
+		}
+		defer l.release(ip, c)
+
+		if l.global == nil && c.bucket == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&limitWriter{ResponseWriter: w, ctx: r.Context(), metrics: m, buckets: []*bucket{c.bucket, l.global}}, r)
+	})
+}
+
+// limitWriter writes at the rate of the slowest of its buckets
+type limitWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	metrics *metrics
+	buckets []*bucket
+}
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := maxChunk
+		for _, b := range w.buckets {
+			if b != nil {
+				chunk = min(chunk, max(int(b.rate), 1))
+			}
+		}
+		chunk = min(chunk, len(p))
+
+		for _, b := range w.buckets {
+			if b == nil {
+				continue
+			}
+			if err := b.wait(w.ctx, chunk, w.metrics); err != nil {
+				return written, err
+			}
+		}
+		n, err := w.ResponseWriter.Write(p[:chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[chunk:]
+	}
+	return written, nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *limitWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
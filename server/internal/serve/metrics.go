@@ -0,0 +1,321 @@
+package serve
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sogladev/go-manifest-patcher/pkg/manifest"
+)
+
+// Headers sent by the downloader to report what is installed
+const (
+	VersionHeader = "X-Patcher-Version" // installed manifest version, empty for a fresh install
+	ChannelHeader = "X-Patcher-Channel" // installed release channel, empty without channels
+)
+
+// ClientWindow is how long a client counts towards the release adoption after its last request
+const ClientWindow = 24 * time.Hour
+
+// metrics collects the counters exposed on /metrics and /stats
+type metrics struct {
+	started time.Time
+	bytes   atomic.Int64
+	active  atomic.Int64
+	delay   atomic.Int64 // nanoseconds spent waiting for limits and throttling
+
+	mu       sync.Mutex
+	requests map[int]int64
+	files    map[string]int64
+	// clients are only recorded when someone can read them on /metrics or /stats
+	recordClients bool
+	clients       map[string]clientRelease
+	pruned        time.Time
+}
+
+// clientRelease is the release last reported by a client IP
+type clientRelease struct {
+	channel string
+	version string
+	seen    time.Time
+}
+
+func newMetrics(recordClients bool) *metrics {
+	return &metrics{
+		started:       time.Now(),
+		requests:      map[int]int64{},
+		files:         map[string]int64{},
+		recordClients: recordClients,
+		clients:       map[string]clientRelease{},
+	}
+}
+
+// addDelay records time a request was held back by bandwidth limits, download slots or throttling
+func (m *metrics) addDelay(delay time.Duration) {
+	if m != nil {
+		m.delay.Add(int64(delay))
+	}
+}
+
+// measure counts every request passing through next
+func (m *metrics) measure(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.active.Add(1)
+		defer m.active.Add(-1)
+
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		m.bytes.Add(sw.bytes)
+
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.requests[sw.status]++
+		// Only existing files get a 200, so unknown paths cannot grow the map
+		name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		if sw.status == http.StatusOK && r.Method == http.MethodGet && name != "metrics" && name != "stats" && !strings.HasPrefix(name, "admin/") {
+			m.files[name]++
+		}
+		if version, ok := r.Header[http.CanonicalHeaderKey(VersionHeader)]; ok && m.recordClients {
+			// Pruned here as well, the map must not grow on servers whose statistics are rarely read
+			now := time.Now()
+			if now.Sub(m.pruned) > time.Minute {
+				m.pruneClients(now)
+			}
+			m.clients[ip] = clientRelease{channel: r.Header.Get(ChannelHeader), version: strings.Join(version, ""), seen: now}
+		}
+	})
+}
+
+// pruneClients forgets clients outside of ClientWindow, it must be called with m.mu held
+func (m *metrics) pruneClients(now time.Time) {
+	m.pruned = now
+	for ip, client := range m.clients {
+		if now.Sub(client.seen) > ClientWindow {
+			delete(m.clients, ip)
+		}
+	}
+}
+
+// activeClients returns the number of clients per channel and installed version, pruning clients outside of ClientWindow
+func (m *metrics) activeClients() map[string]map[string]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pruneClients(time.Now())
+	counts := map[string]map[string]int{}
+	for _, client := range m.clients {
+		if counts[client.channel] == nil {
+			counts[client.channel] = map[string]int{}
+		}
+		counts[client.channel][client.version]++
+	}
+	return counts
+}
+
+// serveMetrics writes the counters in the Prometheus text format
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	m := s.metrics
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	writeMetric(w, "patcher_bytes_served_total", "counter", "Bytes of response bodies sent.")
+	fmt.Fprintf(w, "patcher_bytes_served_total %d\n", m.bytes.Load())
+
+	writeMetric(w, "patcher_active_downloads", "gauge", "Requests currently being served.")
+	fmt.Fprintf(w, "patcher_active_downloads %d\n", m.active.Load())
+
+	writeMetric(w, "patcher_throttle_delay_seconds_total", "counter", "Time requests waited for bandwidth limits, download slots and throttling.")
+	fmt.Fprintf(w, "patcher_throttle_delay_seconds_total %g\n", time.Duration(m.delay.Load()).Seconds())
+
+	m.mu.Lock()
+	writeMetric(w, "patcher_requests_total", "counter", "Requests by HTTP status.")
+	for _, status := range sortedKeys(m.requests) {
+		fmt.Fprintf(w, "patcher_requests_total{status=\"%d\"} %d\n", status, m.requests[status])
+	}
+	writeMetric(w, "patcher_file_downloads_total", "counter", "Complete downloads by file.")
+	for _, name := range sortedKeys(m.files) {
+		fmt.Fprintf(w, "patcher_file_downloads_total{path=\"%s\"} %d\n", escapeLabel(name), m.files[name])
+	}
+	m.mu.Unlock()
+
+	writeMetric(w, "patcher_clients", "gauge", "Clients seen in the last 24 hours by release channel and installed version.")
+	clients := m.activeClients()
+	for _, channel := range sortedKeys(clients) {
+		for _, version := range sortedKeys(clients[channel]) {
+			fmt.Fprintf(w, "patcher_clients{channel=\"%s\",version=\"%s\"} %d\n", escapeLabel(channel), escapeLabel(version), clients[channel][version])
+		}
+	}
+}
+
+func writeMetric(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func sortedKeys[K int | string, V any](values map[K]V) []K {
+	keys := make([]K, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+// Stats is the summary served on /stats
+type Stats struct {
+	Started         time.Time        `json:"started"`
+	BytesServed     int64            `json:"bytes_served"`
+	ActiveDownloads int64            `json:"active_downloads"`
+	Requests        map[string]int64 `json:"requests"`
+	TopFiles        []FileStats      `json:"top_files"`
+	Releases        []ReleaseStats   `json:"releases"`
+}
+
+// FileStats counts the complete downloads of a file
+type FileStats struct {
+	Path      string `json:"path"`
+	Downloads int64  `json:"downloads"`
+}
+
+// ReleaseStats summarizes the adoption of the current version of a manifest
+type ReleaseStats struct {
+	Channel        string         `json:"channel,omitempty"`
+	CurrentVersion string         `json:"current_version"`
+	Clients        int            `json:"clients"`    // clients seen within ClientWindow
+	UpToDate       int            `json:"up_to_date"` // clients reporting the current version
+	Adoption       float64        `json:"adoption"`   // share of up to date clients from 0 to 1
+	Versions       map[string]int `json:"versions"`   // clients per installed version, "" for fresh installs
+}
+
+// topFiles is the number of files listed on /stats
+const topFiles = 20
+
+// serveStats writes a JSON summary of downloads and release adoption
+func (s *Server) serveStats(w http.ResponseWriter, r *http.Request) {
+	m := s.metrics
+	stats := Stats{
+		Started:         m.started,
+		BytesServed:     m.bytes.Load(),
+		ActiveDownloads: m.active.Load(),
+		Requests:        map[string]int64{},
+		TopFiles:        []FileStats{},
+		Releases:        []ReleaseStats{},
+	}
+
+	m.mu.Lock()
+	for status, count := range m.requests {
+		stats.Requests[strconv.Itoa(status)] = count
+	}
+	for name, count := range m.files {
+		stats.TopFiles = append(stats.TopFiles, FileStats{Path: name, Downloads: count})
+	}
+	m.mu.Unlock()
+	sort.Slice(stats.TopFiles, func(i, j int) bool {
+		if stats.TopFiles[i].Downloads != stats.TopFiles[j].Downloads {
+			return stats.TopFiles[i].Downloads > stats.TopFiles[j].Downloads
+		}
+		return stats.TopFiles[i].Path < stats.TopFiles[j].Path
+	})
+	if len(stats.TopFiles) > topFiles {
+		stats.TopFiles = stats.TopFiles[:topFiles]
+	}
+
+	clients := m.activeClients()
+	for _, release := range s.releases() {
+		summary := ReleaseStats{Channel: release.Name, CurrentVersion: release.Version, Versions: clients[release.Name]}
+		if summary.Versions == nil {
+			summary.Versions = map[string]int{}
+		}
+		for version, count := range summary.Versions {
+			summary.Clients += count
+			if version == release.Version {
+				summary.UpToDate += count
+			}
+		}
+		if summary.Clients > 0 {
+			summary.Adoption = float64(summary.UpToDate) / float64(summary.Clients)
+		}
+		stats.Releases = append(stats.Releases, summary)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(stats)
+}
+
+// releases returns the published manifests with their current version: the default manifest
+// and the channels of the channel index, each read from memory or from the root
+func (s *Server) releases() []manifest.Channel {
+	var releases []manifest.Channel
+	if version, ok := s.manifestVersion(s.opts.ManifestName); ok {
+		releases = append(releases, manifest.Channel{Version: version})
+	}
+
+	indexName := path.Join(path.Dir(s.opts.ManifestName), manifest.ChannelIndexFile)
+	data, ok := s.readPublished(indexName)
+	if !ok {
+		return releases
+	}
+	var index manifest.ChannelIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return releases
+	}
+	for _, channel := range index.Channels {
+		name := path.Join(path.Dir(indexName), channel.Manifest)
+		if version, ok := s.manifestVersion(name); ok {
+			channel.Version = version
+			releases = append(releases, channel)
+		}
+	}
+	return releases
+}
+
+// manifestVersion reads the version of a published manifest
+func (s *Server) manifestVersion(name string) (string, bool) {
+	data, ok := s.readPublished(name)
+	if !ok {
+		return "", false
+	}
+	var header struct {
+		Version string `json:"Version"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return "", false
+	}
+	return header.Version, true
+}
+
+// readPublished returns a document published in memory or a file below the root
+func (s *Server) readPublished(name string) ([]byte, bool) {
+	if documents := s.documents.Load(); documents != nil {
+		if doc, ok := (*documents)[name]; ok {
+			return doc.data, true
+		}
+	}
+	filePath, err := manifest.ResolvePath(s.opts.Root, name)
+	if err != nil {
+		return nil, false
+	}
+	data, err := os.ReadFile(filePath)
+	return data, err == nil
+}
@@ -0,0 +1,334 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sogladev/go-manifest-patcher/pkg/manifest"
+)
+
+// ShutdownTimeout is how long running downloads may take to finish after a shutdown request
+const ShutdownTimeout = 30 * time.Second
+
+// Options configures the patch server
+type Options struct {
+	// Addr is the listen address, e.g. ":8080"
+	Addr string
+	// Root is the directory with the published content, nothing outside of it is served
+	Root string
+	// Paths are the files and directories below the root that are served, such as the manifest,
+	// its signature and the files directory. Other files below the root are not served.
+	Paths []string
+	// ThrottleInterval is the delay per ThrottleChunk bytes, 0 disables throttling
+	ThrottleInterval time.Duration
+	ThrottleChunk    int
+	// AccessLog receives one line per request, nil disables access logging
+	AccessLog *log.Logger
+	// TLSCertFile and TLSKeyFile enable HTTPS when both are set
+	TLSCertFile string
+	TLSKeyFile  string
+	// Faults are injected into matching requests to test the downloader, see LoadFaults
+	Faults []Fault
+	// Limits caps bandwidth and concurrent downloads
+	Limits Limits
+	// ManifestName is the path of the default manifest below the root, the channel index is
+	// expected next to it. It defaults to manifest.json and is used for release statistics.
+	ManifestName string
+	// Metrics serves Prometheus metrics on /metrics, Stats a JSON summary on /stats
+	Metrics bool
+	Stats   bool
+	// MetricsAddr serves /metrics and /stats on a separate address instead, e.g. an internal interface
+	MetricsAddr string
+	// Auth, when set, requires a token or a signed URL for manifests and files.
+	// /metrics and /stats are not covered, use MetricsAddr to keep them private.
+	Auth *Auth
+}
+
+// Server serves published manifests and files
+type Server struct {
+	opts      Options
+	mux       *http.ServeMux
+	documents atomic.Pointer[map[string]document]
+	publishMu sync.Mutex
+	metrics   *metrics
+}
+
+// document is content served from memory instead of the root directory
+type document struct {
+	data     []byte
+	modified time.Time
+	etag     string
+}
+
+// New creates a server for opts
+func New(opts Options) *Server {
+	if opts.Root == "" {
+		opts.Root = "."
+	}
+	if opts.ThrottleChunk <= 0 {
+		opts.ThrottleChunk = 1024
+	}
+	if opts.ManifestName == "" {
+		opts.ManifestName = "manifest.json"
+	}
+	s := &Server{opts: opts, mux: http.NewServeMux(), metrics: newMetrics(opts.Metrics || opts.Stats)}
+	var files http.Handler = http.HandlerFunc(s.serveFile)
+	if opts.Auth != nil {
+		files = opts.Auth.Protect(files)
+	}
+	s.mux.Handle("/", files)
+	if opts.MetricsAddr == "" {
+		s.registerMetrics(s.mux)
+	}
+	return s
+}
+
+// Handle serves pattern with handler instead of the files below the root, it must be called before Run
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// registerMetrics adds the enabled metrics endpoints to mux
+func (s *Server) registerMetrics(mux *http.ServeMux) {
+	if s.opts.Metrics {
+		mux.HandleFunc("/metrics", s.serveMetrics)
+	}
+	if s.opts.Stats {
+		mux.HandleFunc("/stats", s.serveStats)
+	}
+}
+
+// Handler returns the handler serving all requests
+func (s *Server) Handler() http.Handler {
+	var handler http.Handler = s.mux
+	if len(s.opts.Faults) > 0 {
+		handler = injectFaults(s.opts.Faults, handler)
+	}
+	if s.opts.Limits != (Limits{}) {
+		handler = limit(s.opts.Limits, s.metrics, handler)
+	}
+	handler = s.metrics.measure(handler)
+	if s.opts.AccessLog != nil {
+		handler = accessLog(s.opts.AccessLog, handler)
+	}
+	return handler
+}
+
+// Run serves until ctx is cancelled, then waits for running requests to finish
+func (s *Server) Run(ctx context.Context) error {
+	server := &http.Server{
+		Addr:              s.opts.Addr,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	if s.opts.TLSCertFile != "" && s.opts.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.opts.TLSCertFile, s.opts.TLSKeyFile)
+		if err != nil {
+			return fmt.Errorf("error loading TLS certificate: %v", err)
+		}
+		server.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+		log.Printf("Serving HTTPS, certificate fingerprint (SHA-256): %s", Fingerprint(cert))
+	}
+
+	errs := make(chan error, 2)
+
+	// Metrics on a separate address are kept off the public listener
+	var metricsServer *http.Server
+	if s.opts.MetricsAddr != "" && (s.opts.Metrics || s.opts.Stats) {
+		mux := http.NewServeMux()
+		s.registerMetrics(mux)
+		metricsServer = &http.Server{Addr: s.opts.MetricsAddr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			errs <- metricsServer.ListenAndServe()
+		}()
+		log.Printf("Serving metrics on %s", s.opts.MetricsAddr)
+	}
+
+	go func() {
+		if server.TLSConfig != nil {
+			errs <- server.ListenAndServeTLS("", "")
+		} else {
+			errs <- server.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down, waiting up to %s for running downloads", ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	if metricsServer != nil {
+		metricsServer.Shutdown(shutdownCtx)
+	}
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Publish serves documents, keyed by path below the root, from memory instead of from disk.
+// A nil document is removed. All given documents are replaced at once, so a manifest and its
+// signature always match.
+func (s *Server) Publish(documents map[string][]byte) {
+	s.publishMu.Lock()
+	defer s.publishMu.Unlock()
+
+	published := map[string]document{}
+	if current := s.documents.Load(); current != nil {
+		for name, doc := range *current {
+			published[name] = doc
+		}
+	}
+	for name, data := range documents {
+		if data == nil {
+			delete(published, name)
+			continue
+		}
+		sum := md5.Sum(data)
+		published[name] = document{
+			data:     data,
+			modified: time.Now(),
+			etag:     `"` + hex.EncodeToString(sum[:]) + `"`,
+		}
+	}
+	s.documents.Store(&published)
+}
+
+// serveFile serves a published file below the root directory
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if documents := s.documents.Load(); documents != nil {
+		if doc, ok := (*documents)[name]; ok {
+			w.Header().Set("ETag", doc.etag)
+			w.Header().Set("Cache-Control", "no-cache")
+			http.ServeContent(w, r, path.Base(name), doc.modified, bytes.NewReader(doc.data))
+			return
+		}
+	}
+	if !s.Published(name) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Rejects paths and symlinks leading outside of the root
+	filePath, err := manifest.ResolvePath(s.opts.Root, name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+
+	// Directory listings would expose unpublished files
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Serve a pre-compressed copy when the client accepts its encoding, the copy has its own ETag
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if compressed, compressedInfo, encoding, vary := s.precompressed(r, name, info); vary {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if compressed != nil {
+			defer compressed.Close()
+			file, info = compressed, compressedInfo
+			w.Header().Set("Content-Encoding", encoding)
+			// ServeContent leaves it out for encoded content, range responses replace it
+			w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+			if contentType == "" {
+				// Sniffing would detect the compressed data
+				contentType = "application/octet-stream"
+			}
+		}
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+
+	w.Header().Set("ETag", etag(info))
+	if strings.HasPrefix(name, "objects/") {
+		// Objects are named after their content and never change, clients and proxies may cache them forever.
+		// Shared caches must not hand out objects that require authentication.
+		visibility := "public"
+		if s.opts.Auth != nil {
+			visibility = "private"
+		}
+		w.Header().Set("Cache-Control", visibility+", max-age=31536000, immutable")
+	}
+
+	var content io.ReadSeeker = file
+	if s.opts.ThrottleInterval > 0 {
+		content = &ThrottledReader{
+			reader:   file,
+			interval: s.opts.ThrottleInterval,
+			chunk:    s.opts.ThrottleChunk,
+			metrics:  s.metrics,
+		}
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), content)
+}
+
+// Published reports whether a path below the root may be served, it must be one of the served paths
+// or below one of them. Hidden files and private keys are never served, even inside a served directory.
+func (s *Server) Published(name string) bool {
+	if name == "" || name == "." {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return false
+		}
+	}
+	if strings.HasSuffix(name, ".key") {
+		return false
+	}
+	for _, served := range s.opts.Paths {
+		if served == "." || name == served || strings.HasPrefix(name, served+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// etag derives a validator from the file metadata, so files are not read to answer conditional requests
+func etag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano())
+}
@@ -0,0 +1,32 @@
+package serve
+
+import (
+	"io"
+	"time"
+)
+
+// ThrottledReader wraps an io.ReadSeeker and throttles the data being read
+type ThrottledReader struct {
+	reader   io.ReadSeeker
+	interval time.Duration
+	chunk    int
+	metrics  *metrics
+}
+
+// Read reads data in chunks and introduces a delay between reads
+func (t *ThrottledReader) Read(p []byte) (int, error) {
+	if len(p) > t.chunk {
+		p = p[:t.chunk] // Limit the read size to the defined chunk size
+	}
+	n, err := t.reader.Read(p)
+	if n > 0 {
+		time.Sleep(t.interval) // Simulate bandwidth delay
+		t.metrics.addDelay(t.interval)
+	}
+	return n, err
+}
+
+// Seek sets the offset for the next Read operation
+func (t *ThrottledReader) Seek(offset int64, whence int) (int64, error) {
+	return t.reader.Seek(offset, whence)
+}
@@ -0,0 +1,227 @@
+package watch
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sogladev/go-manifest-patcher/pkg/manifest"
+)
+
+// Version policies
+const (
+	PolicyPatch     = "patch"     // 1.2.3 -> 1.2.4
+	PolicyMinor     = "minor"     // 1.2.3 -> 1.3.0
+	PolicyMajor     = "major"     // 1.2.3 -> 2.0.0
+	PolicyTimestamp = "timestamp" // UTC date and time, e.g. 20261019.153000
+	PolicyNone      = "none"      // keep the version
+)
+
+// Options configures the watcher
+type Options struct {
+	// Generate describes the manifest, Previous and Version are taken from the current manifest
+	Generate manifest.GenerateOptions
+	// Interval is how often the files are checked for changes
+	Interval time.Duration
+	// Debounce is how long the files must stay unchanged before the manifest is regenerated
+	Debounce time.Duration
+	// Policy selects how the version is bumped for every new manifest
+	Policy string
+	// Publish is called with the written manifest and its signature, which is nil for unsigned manifests
+	Publish func(m *manifest.Manifest, data, signature []byte)
+}
+
+// Run regenerates the manifest whenever the files change, until ctx is cancelled.
+// An existing manifest is published first and used for incremental hashing.
+func Run(ctx context.Context, opts Options) error {
+	w := &watcher{opts: opts}
+	if err := w.loadCurrent(); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+
+	last := w.snapshot()
+	w.regenerate()
+	var changedAt time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		// Wait for the files to settle, an upload of many files should result in one new version
+		if current := w.snapshot(); current != last {
+			last = current
+			changedAt = time.Now()
+			continue
+		}
+		if !changedAt.IsZero() && time.Since(changedAt) >= opts.Debounce {
+			changedAt = time.Time{}
+			w.regenerate()
+		}
+	}
+}
+
+type watcher struct {
+	opts    Options
+	current *manifest.Manifest
+}
+
+// loadCurrent publishes the manifest written by an earlier run
+func (w *watcher) loadCurrent() error {
+	output := w.opts.Generate.OutputFile
+	data, err := os.ReadFile(output)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	w.current, err = manifest.ParseManifest(data, manifest.LoadOptions{})
+	if err != nil {
+		return fmt.Errorf("error loading current manifest %s: %v", output, err)
+	}
+
+	signature, err := os.ReadFile(output + manifest.SignatureSuffix)
+	if err != nil || w.opts.Generate.SigningKey == nil {
+		signature = nil
+	}
+	w.opts.Publish(w.current, data, signature)
+	return nil
+}
+
+// regenerate builds a new manifest and publishes it when files changed.
+// On errors the current manifest stays published.
+func (w *watcher) regenerate() {
+	opts := w.opts.Generate
+	opts.SkipWrite = true
+	opts.Previous = w.current
+	if w.current != nil {
+		opts.Version = w.current.Version
+	}
+
+	result, err := manifest.GenerateManifest(opts)
+	if err != nil {
+		log.Printf("Error regenerating manifest, keeping the current one: %v", err)
+		return
+	}
+	for _, skipped := range result.Skipped {
+		log.Printf("Skipped %s: %s", skipped.Path, skipped.Error)
+	}
+
+	m := result.Manifest
+	if w.current != nil {
+		if !result.Changes.HasChanges() {
+			return
+		}
+		if m.Version, err = BumpVersion(w.current.Version, w.opts.Policy); err != nil {
+			log.Printf("Error bumping version, keeping the current manifest: %v", err)
+			return
+		}
+	}
+
+	data, signature, err := manifest.WriteManifest(m, opts.OutputFile, opts.SigningKey)
+	if err != nil {
+		log.Printf("Error writing manifest, keeping the current one: %v", err)
+		return
+	}
+	w.opts.Publish(m, data, signature)
+	w.current = m
+
+	if changes := result.Changes; changes != nil {
+		log.Printf("Published version %s: %d added, %d changed, %d removed, %d moved (hashed %d, reused %d)",
+			m.Version, len(changes.Added), len(changes.Changed), len(changes.Removed), len(changes.Moved), result.Hashed, result.Reused)
+	} else {
+		log.Printf("Published version %s with %d files", m.Version, len(m.Files))
+	}
+}
+
+// snapshot fingerprints the names, sizes and modification times of all watched files
+func (w *watcher) snapshot() uint64 {
+	opts := w.opts.Generate
+	skip := map[string]bool{
+		filepath.Clean(opts.OutputFile):                            true,
+		filepath.Clean(opts.OutputFile + manifest.SignatureSuffix): true,
+	}
+	if opts.ObjectsDir != "" {
+		skip[filepath.Clean(opts.ObjectsDir)] = true
+	}
+
+	hash := fnv.New64a()
+	roots := []string{opts.FilesDir}
+	for _, tree := range opts.Platforms {
+		roots = append(roots, tree.Dir)
+	}
+	for _, root := range roots {
+		filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if skip[filepath.Clean(path)] {
+				if d != nil && d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			// Compressed copies are written by the generator itself
+			if d != nil && !d.IsDir() && manifest.IsCompressedCopy(path, opts.Compress) {
+				return nil
+			}
+			fmt.Fprintf(hash, "%s\x00", path)
+			if err != nil {
+				fmt.Fprintf(hash, "%v\x00", err)
+				return nil
+			}
+			if info, err := d.Info(); err == nil {
+				fmt.Fprintf(hash, "%d\x00%d\x00%d\x00", info.Size(), info.ModTime().UnixNano(), info.Mode())
+			}
+			return nil
+		})
+	}
+	return hash.Sum64()
+}
+
+// BumpVersion returns the version following version under policy.
+// Missing components count as 0, so "1.0" becomes "1.0.1" with the patch policy.
+func BumpVersion(version, policy string) (string, error) {
+	index := 0
+	switch policy {
+	case PolicyNone:
+		return version, nil
+	case PolicyTimestamp:
+		return time.Now().UTC().Format("20060102.150405"), nil
+	case PolicyMajor:
+		index = 0
+	case PolicyMinor:
+		index = 1
+	case PolicyPatch:
+		index = 2
+	default:
+		return "", fmt.Errorf("unknown version policy %q", policy)
+	}
+
+	parts := strings.Split(strings.TrimPrefix(version, "v"), ".")
+	for len(parts) <= index {
+		parts = append(parts, "0")
+	}
+	number, err := strconv.Atoi(parts[index])
+	if err != nil {
+		return "", fmt.Errorf("version %q has no number at position %d, use the timestamp or none policy", version, index+1)
+	}
+	parts[index] = strconv.Itoa(number + 1)
+	for i := index + 1; i < len(parts); i++ {
+		parts[i] = "0"
+	}
+
+	bumped := strings.Join(parts, ".")
+	if strings.HasPrefix(version, "v") {
+		bumped = "v" + bumped
+	}
+	return bumped, nil
+}
@@ -1,90 +1,495 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/sogladev/go-manifest-patcher/pkg/manifest"
+	"github.com/sogladev/go-manifest-patcher/server/internal/admin"
 	"github.com/sogladev/go-manifest-patcher/server/internal/config"
+	"github.com/sogladev/go-manifest-patcher/server/internal/diff"
+	"github.com/sogladev/go-manifest-patcher/server/internal/serve"
+	"github.com/sogladev/go-manifest-patcher/server/internal/watch"
 )
 
-// ThrottledReader wraps an io.ReadSeeker and throttles the data being read
-type ThrottledReader struct {
-	reader   io.ReadSeeker
-	interval time.Duration
-	chunk    int
+// generateOptions builds the manifest generator options from the configuration
+func generateOptions(cfg *config.Config) manifest.GenerateOptions {
+	opts := manifest.GenerateOptions{
+		FilesDir:        cfg.FilesDir,
+		PathPrefix:      cfg.PathPrefix,
+		BaseURL:         cfg.BaseURL,
+		URLRoot:         cfg.URLRoot,
+		Version:         cfg.Version,
+		OutputFile:      cfg.OutputFile,
+		IncludePatterns: cfg.Include,
+		ExcludePatterns: cfg.Exclude,
+		CustomPatterns:  cfg.CustomPatterns,
+		Platforms:       cfg.Platforms,
+		Workers:         cfg.Workers,
+		ObjectsDir:      cfg.ObjectsDir,
+		Lenient:         cfg.Lenient,
+		Compress:        cfg.Compress,
+	}
+	if cfg.HooksFile != "" {
+		hooks, err := manifest.LoadHooks(cfg.HooksFile)
+		if err != nil {
+			log.Fatalf("Error loading hooks: %v", err)
+		}
+		opts.Hooks = hooks
+	}
+	if cfg.ChangelogFile != "" {
+		changelog, err := os.ReadFile(cfg.ChangelogFile)
+		if err != nil {
+			log.Fatalf("Error loading changelog: %v", err)
+		}
+		opts.Changelog = strings.TrimSpace(string(changelog))
+	}
+	if cfg.SignKey != "" {
+		key, err := manifest.LoadPrivateKey(cfg.SignKey)
+		if err != nil {
+			log.Fatalf("Error loading signing key: %v", err)
+		}
+		opts.SigningKey = key
+	}
+	return opts
 }
 
-// Read reads data in chunks and introduces a delay between reads
-func (t *ThrottledReader) Read(p []byte) (int, error) {
-	if len(p) > t.chunk {
-		p = p[:t.chunk] // Limit the read size to the defined chunk size
+// createManifest generates a single manifest and prints the result, channel is empty without channels
+func createManifest(cfg *config.Config, opts manifest.GenerateOptions, channel string) *manifest.Manifest {
+	if cfg.Progress != "json" {
+		if channel != "" {
+			fmt.Printf("Generating manifest for channel %s...\n", channel)
+		} else {
+			fmt.Println("Generating manifest...")
+		}
 	}
-	n, err := t.reader.Read(p)
-	if n > 0 {
-		time.Sleep(t.interval) // Simulate bandwidth delay
+	opts.Progress = progressReporter(cfg.Progress)
+	if cfg.Incremental {
+		if data, err := os.ReadFile(opts.OutputFile); err == nil {
+			previous, err := manifest.ParseManifest(data, manifest.LoadOptions{})
+			if err != nil {
+				log.Fatalf("Error loading previous manifest: %v", err)
+			}
+			opts.Previous = previous
+		}
+	}
+	result, err := manifest.GenerateManifest(opts)
+	if err != nil {
+		var generateErr *manifest.GenerateError
+		if cfg.Progress == "json" && errors.As(err, &generateErr) {
+			printJSON(map[string]any{"event": "failed", "channel": channel, "problems": generateErr.Problems})
+		}
+		log.Fatalf("Error generating manifest: %v", err)
+	}
+	if cfg.Progress == "json" {
+		printJSON(map[string]any{
+			"event":      "done",
+			"channel":    channel,
+			"version":    result.Manifest.Version,
+			"hashed":     result.Hashed,
+			"reused":     result.Reused,
+			"stored":     result.Stored,
+			"compressed": result.Compressed,
+			"skipped":    result.Skipped,
+			"changes":    result.Changes,
+		})
+		return result.Manifest
+	}
+	for _, skipped := range result.Skipped {
+		fmt.Printf("Skipped %s: %s\n", skipped.Path, skipped.Error)
+	}
+	fmt.Printf("Hashed %d files, reused %d hashes from the previous manifest.\n", result.Hashed, result.Reused)
+	if cfg.ObjectsDir != "" {
+		fmt.Printf("Stored %d new objects in %s.\n", result.Stored, cfg.ObjectsDir)
+	}
+	if cfg.Compress {
+		fmt.Printf("Wrote %d new gzip copies.\n", result.Compressed)
+	}
+	if changes := result.Changes; changes != nil {
+		fmt.Printf("Changes since %s: %d added, %d changed, %d removed, %d moved.\n",
+			changes.OldVersion, len(changes.Added), len(changes.Changed), len(changes.Removed), len(changes.Moved))
+	}
+	fmt.Println("Manifest generated successfully.")
+	return result.Manifest
+}
+
+// createChannels generates the manifest of every channel and the channel index
+func createChannels(cfg *config.Config) {
+	index := channelIndex(cfg)
+	for _, channel := range cfg.Channels {
+		m := createManifest(cfg, channelOptions(cfg, channel), channel.Name)
+		index.SetVersion(channel.Name, m.Version)
+	}
+	if err := manifest.WriteChannelIndex(index, channelIndexFile(cfg)); err != nil {
+		log.Fatalf("Error writing channel index: %v", err)
+	}
+	if cfg.Progress != "json" {
+		fmt.Printf("Channel index written to %s.\n", channelIndexFile(cfg))
 	}
-	return n, err
 }
 
-// Seek sets the offset for the next Read operation
-func (t *ThrottledReader) Seek(offset int64, whence int) (int64, error) {
-	return t.reader.Seek(offset, whence)
+// channelIndexFile is the channel index next to the default manifest
+func channelIndexFile(cfg *config.Config) string {
+	return filepath.Join(filepath.Dir(cfg.OutputFile), filepath.FromSlash(manifest.ChannelIndexFile))
+}
+
+// channelIndex lists the configured channels, the first one is the default
+func channelIndex(cfg *config.Config) *manifest.ChannelIndex {
+	index := &manifest.ChannelIndex{Default: cfg.Channels[0].Name}
+	for _, channel := range cfg.Channels {
+		index.Channels = append(index.Channels, manifest.Channel{
+			Name:     channel.Name,
+			Manifest: channel.Name + "/manifest.json",
+		})
+	}
+	return index
+}
+
+// channelOptions generates the manifest of a channel from its own directory into channels/<name>/manifest.json
+func channelOptions(cfg *config.Config, channel config.Channel) manifest.GenerateOptions {
+	opts := generateOptions(cfg)
+	opts.FilesDir = channel.Dir
+	opts.OutputFile = filepath.Join(filepath.Dir(channelIndexFile(cfg)), channel.Name, "manifest.json")
+	if channel.Version != "" {
+		opts.Version = channel.Version
+	}
+	return opts
+}
+
+// belowRoot returns the path of file below the served root with forward slashes, ok is false for files
+// outside of it. Both are made absolute first, an absolute root works with the relative default paths.
+func belowRoot(cfg *config.Config, file string) (name string, ok bool) {
+	root, err := filepath.Abs(cfg.Root)
+	if err != nil {
+		return "", false
+	}
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return "", false
+	}
+	name, err = filepath.Rel(root, abs)
+	if err != nil || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(name), true
+}
+
+// servedName returns the path of file below the served root
+func servedName(cfg *config.Config, file string) string {
+	name, ok := belowRoot(cfg, file)
+	if !ok {
+		log.Fatalf("%s must be inside the served directory %s", file, cfg.Root)
+	}
+	return name
+}
+
+// servedPaths lists the paths below the served root that are published: the manifest and its signature,
+// the channel manifests, the files directories, the object store, the releases of the admin API and -serve-paths
+func servedPaths(cfg *config.Config) []string {
+	files := []string{cfg.OutputFile, cfg.OutputFile + manifest.SignatureSuffix, cfg.FilesDir}
+	for _, tree := range cfg.Platforms {
+		files = append(files, tree.Dir)
+	}
+	if len(cfg.Channels) > 0 {
+		files = append(files, filepath.Dir(channelIndexFile(cfg)))
+		for _, channel := range cfg.Channels {
+			files = append(files, channel.Dir)
+		}
+	}
+	if cfg.ObjectsDir != "" {
+		files = append(files, cfg.ObjectsDir)
+	}
+	if cfg.AdminTokens != "" {
+		files = append(files, cfg.ReleasesDir)
+	}
+
+	var paths []string
+	for _, file := range files {
+		// Content outside of the root is served by someone else, e.g. a CDN
+		if name, ok := belowRoot(cfg, file); ok {
+			paths = append(paths, name)
+		}
+	}
+	for _, name := range cfg.ServePaths {
+		paths = append(paths, filepath.ToSlash(filepath.Clean(name)))
+	}
+	return paths
+}
+
+// serves reports whether server publishes file
+func serves(cfg *config.Config, server *serve.Server, file string) bool {
+	name, ok := belowRoot(cfg, file)
+	return ok && server.Published(name)
+}
+
+// publishManifest serves a new version of the manifest file from memory
+func publishManifest(cfg *config.Config, server *serve.Server, file string, data, signature []byte) {
+	name := servedName(cfg, file)
+	// A nil document removes the signature of an unsigned manifest
+	server.Publish(map[string][]byte{name: data, name + manifest.SignatureSuffix: signature})
+}
+
+// serveAdmin enables the admin API for publishing releases
+func serveAdmin(cfg *config.Config, server *serve.Server) {
+	tokens, err := serve.LoadTokens(cfg.AdminTokens)
+	if err != nil {
+		log.Fatalf("Error loading admin tokens: %v", err)
+	}
+	servedName(cfg, cfg.OutputFile)
+	api, err := admin.New(admin.Options{
+		Dir:       cfg.ReleasesDir,
+		Generate:  generateOptions(cfg),
+		LiveFile:  cfg.OutputFile,
+		MaxUpload: cfg.MaxUpload,
+		Publish: func(m *manifest.Manifest, data, signature []byte) {
+			publishManifest(cfg, server, cfg.OutputFile, data, signature)
+			log.Printf("Published version %s with %d files", m.Version, len(m.Files))
+		},
+	})
+	if err != nil {
+		log.Fatalf("Error starting admin API: %v", err)
+	}
+	// Admin tokens are separate from download tokens, signed URLs are never accepted
+	server.Handle("/admin/", (&serve.Auth{Tokens: tokens}).Protect(api.Handler()))
+	log.Printf("Admin API enabled on /admin/ with %d tokens, releases are stored in %s", len(tokens), cfg.ReleasesDir)
+}
+
+// watchManifests regenerates the manifest, or the manifests of all channels, whenever files change
+func watchManifests(ctx context.Context, cfg *config.Config, server *serve.Server) {
+	publish := func(file string, data, signature []byte) {
+		publishManifest(cfg, server, file, data, signature)
+	}
+	start := func(opts manifest.GenerateOptions, published func(m *manifest.Manifest, data, signature []byte)) {
+		servedName(cfg, opts.OutputFile)
+		watchOptions := watch.Options{
+			Generate: opts,
+			Interval: cfg.WatchInterval,
+			Debounce: cfg.Debounce,
+			Policy:   cfg.VersionPolicy,
+			Publish:  published,
+		}
+		go func() {
+			if err := watch.Run(ctx, watchOptions); err != nil {
+				log.Fatalf("Error watching files: %v", err)
+			}
+		}()
+		log.Printf("Watching %s, the manifest is regenerated %s after the last change", opts.FilesDir, cfg.Debounce)
+	}
+
+	if len(cfg.Channels) == 0 {
+		start(generateOptions(cfg), func(m *manifest.Manifest, data, signature []byte) {
+			publish(cfg.OutputFile, data, signature)
+		})
+		return
+	}
+
+	// The index lists the current version of every channel
+	var mu sync.Mutex
+	index := channelIndex(cfg)
+	indexFile := channelIndexFile(cfg)
+	for _, channel := range cfg.Channels {
+		opts := channelOptions(cfg, channel)
+		start(opts, func(m *manifest.Manifest, data, signature []byte) {
+			mu.Lock()
+			defer mu.Unlock()
+			publish(opts.OutputFile, data, signature)
+			index.SetVersion(channel.Name, m.Version)
+			if err := manifest.WriteChannelIndex(index, indexFile); err != nil {
+				log.Printf("Error writing channel index: %v", err)
+				return
+			}
+			indexData, err := os.ReadFile(indexFile)
+			if err != nil {
+				log.Printf("Error reading channel index: %v", err)
+				return
+			}
+			server.Publish(map[string][]byte{servedName(cfg, indexFile): indexData})
+		})
+	}
+}
+
+// progressReporter returns the generator progress callback for the -progress mode
+func progressReporter(mode string) func(manifest.ProgressEvent) {
+	switch mode {
+	case "text":
+		return func(event manifest.ProgressEvent) {
+			if event.Error != "" {
+				fmt.Printf("[%d/%d] %s %s: %s\n", event.Done, event.Total, event.Event, event.Path, event.Error)
+			} else {
+				fmt.Printf("[%d/%d] %s %s\n", event.Done, event.Total, event.Event, event.Path)
+			}
+		}
+	case "json":
+		return func(event manifest.ProgressEvent) {
+			printJSON(event)
+		}
+	}
+	return nil
+}
+
+// printJSON writes v as a single line of JSON to stdout
+func printJSON(v any) {
+	if err := json.NewEncoder(os.Stdout).Encode(v); err != nil {
+		log.Printf("Error writing progress: %v", err)
+	}
 }
 
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		os.Exit(diff.Run(os.Args[2:]))
+	}
+
 	// Initialize configuration
 	cfg := config.InitConfig()
 
 	flag.Parse()
 
-	if cfg.CreateManifest {
-		fmt.Println("Generating manifest...")
-		err := manifest.GenerateManifest(cfg.FilesDir, cfg.BaseURL, cfg.Version)
+	if cfg.GenerateKeys {
+		if err := manifest.GenerateKeyPair("manifest.key", "manifest.pub"); err != nil {
+			log.Fatalf("Error generating keys: %v", err)
+		}
+		fmt.Println("Generated manifest.key (keep private) and manifest.pub (distribute to clients).")
+		return
+	}
+
+	if cfg.SignURL != "" {
+		key, err := serve.LoadURLKey(cfg.URLKey)
 		if err != nil {
-			log.Fatalf("Error generating manifest: %v", err)
+			log.Fatalf("Error loading URL key: %v", err)
 		}
-		fmt.Println("Manifest generated successfully.")
-		return // Exit after generating the manifest
+		signed, err := serve.SignURL(cfg.SignURL, cfg.URLPrefixes, time.Now().Add(cfg.URLExpiry), key)
+		if err != nil {
+			log.Fatalf("Error signing URL: %v", err)
+		}
+		fmt.Println(signed)
+		return
 	}
 
-	// Custom handler to throttle file downloads
-	http.HandleFunc("/files/", func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Throttling request for: %s\n", r.URL.Path)
+	if cfg.CreateManifest {
+		if len(cfg.Channels) > 0 {
+			createChannels(cfg)
+		} else {
+			createManifest(cfg, generateOptions(cfg), "")
+		}
+		return // Exit after generating the manifest
+	}
 
-		// Open the requested file
-		filePath := r.URL.Path[1:]
-		file, err := os.Open(filePath)
+	// Access log on stderr unless written to a file or disabled
+	var accessLog *log.Logger
+	switch cfg.AccessLog {
+	case "":
+	case "-":
+		accessLog = log.New(os.Stderr, "", log.LstdFlags)
+	default:
+		logFile, err := os.OpenFile(cfg.AccessLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 		if err != nil {
-			http.Error(w, "File not found", http.StatusNotFound)
-			return
+			log.Fatalf("Error opening access log: %v", err)
+		}
+		defer logFile.Close()
+		accessLog = log.New(logFile, "", log.LstdFlags)
+	}
+
+	// Self-signed certificates are generated once and reused, so pinned fingerprints stay valid
+	if cfg.TLSSelfSigned {
+		if _, err := os.Stat(cfg.TLSCert); os.IsNotExist(err) {
+			if err := serve.GenerateCertificate(cfg.TLSCert, cfg.TLSKey, cfg.TLSHosts); err != nil {
+				log.Fatalf("Error generating self-signed certificate: %v", err)
+			}
+			log.Printf("Generated self-signed certificate %s for %s", cfg.TLSCert, strings.Join(cfg.TLSHosts, ", "))
+		}
+	}
+
+	var err error
+	var faults []serve.Fault
+	if cfg.FaultsFile != "" {
+		if faults, err = serve.LoadFaults(cfg.FaultsFile); err != nil {
+			log.Fatalf("Error loading faults: %v", err)
 		}
-		defer file.Close()
+		log.Printf("Injecting faults from %s, do not use in production", cfg.FaultsFile)
+	}
 
-		// Wrap the file in a ThrottledReader
-		throttledReader := &ThrottledReader{
-			reader:   file,
-			interval: time.Duration(cfg.Interval) * time.Millisecond, // ms delay per chunk
-			chunk:    1024,                                           // 1KB per chunk
+	// Manifests and files require a token or a signed URL once either is configured
+	var auth *serve.Auth
+	if cfg.AuthTokens != "" || cfg.URLKey != "" {
+		auth = &serve.Auth{}
+		if cfg.AuthTokens != "" {
+			if auth.Tokens, err = serve.LoadTokens(cfg.AuthTokens); err != nil {
+				log.Fatalf("Error loading access tokens: %v", err)
+			}
+		}
+		if cfg.URLKey != "" {
+			if auth.URLKey, err = serve.LoadURLKey(cfg.URLKey); err != nil {
+				log.Fatalf("Error loading URL key: %v", err)
+			}
 		}
+		log.Printf("Manifests and files require authentication (%d access tokens, signed URLs: %t)", len(auth.Tokens), auth.URLKey != nil)
+	}
 
-		// Serve the content using the throttled reader
-		http.ServeContent(w, r, filePath, time.Now(), throttledReader)
+	// Release statistics read the manifest and the channel index from below the root
+	manifestName, ok := belowRoot(cfg, cfg.OutputFile)
+	if !ok {
+		manifestName = filepath.Base(cfg.OutputFile)
+	}
+
+	server := serve.New(serve.Options{
+		Addr:             cfg.Addr,
+		Root:             cfg.Root,
+		Paths:            servedPaths(cfg),
+		ThrottleInterval: time.Duration(cfg.Interval) * time.Millisecond,
+		AccessLog:        accessLog,
+		TLSCertFile:      cfg.TLSCert,
+		TLSKeyFile:       cfg.TLSKey,
+		Faults:           faults,
+		Limits: serve.Limits{
+			Rate:         cfg.RateLimit,
+			ClientRate:   cfg.ClientRate,
+			MaxPerClient: cfg.MaxPerClient,
+			QueueTimeout: cfg.QueueTimeout,
+		},
+		ManifestName: manifestName,
+		Metrics:      cfg.Metrics,
+		Stats:        cfg.Stats,
+		MetricsAddr:  cfg.MetricsAddr,
+		Auth:         auth,
 	})
 
-	// Fallback handler for all other requests
-	http.Handle("/", http.FileServer(http.Dir("./")))
+	// Token files, keys, hooks and faults must never be downloadable, e.g. from inside the files directory
+	for _, secret := range []string{cfg.AdminTokens, cfg.AuthTokens, cfg.URLKey, cfg.SignKey, cfg.HooksFile, cfg.FaultsFile} {
+		if secret != "" && serves(cfg, server, secret) {
+			log.Fatalf("%s would be downloadable, move it out of the published content below %s", secret, cfg.Root)
+		}
+	}
+
+	// Stop accepting connections on Ctrl+C or SIGTERM and let running downloads finish
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// Start the server
-	port := "8080"
-	log.Printf("Starting local server on http://localhost:%s/", port)
-	err := http.ListenAndServe(":"+port, nil)
-	if err != nil {
+	if cfg.AdminTokens != "" {
+		serveAdmin(cfg, server)
+	}
+
+	// Regenerate the manifests on file changes and serve each new version from memory
+	if cfg.Watch {
+		watchManifests(ctx, cfg, server)
+	}
+
+	log.Printf("Serving %s on %s", cfg.Root, cfg.Addr)
+	if cfg.Interval > 0 {
+		log.Printf("Throttling downloads to 1KB per %dms", cfg.Interval)
+	}
+	if err := server.Run(ctx); err != nil {
 		log.Fatal(err)
 	}
 }